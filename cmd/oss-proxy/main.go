@@ -1,19 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli"
 
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/ftp"
 	"github.com/srelab/ossproxy/pkg/g"
 	"github.com/srelab/ossproxy/pkg/http"
 	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/privilege"
 	"github.com/srelab/ossproxy/pkg/sftp"
 	"github.com/srelab/ossproxy/pkg/util"
 )
 
+// flags which may be left empty
+var optionalFlags = map[string]bool{
+	"storage.endpoint": true,
+	"ak.sts":           true,
+	"ftp.passive.host": true,
+	"http.jwt.secret":  true,
+}
+
+// flags holding a duration, checked at startup since an invalid value
+// would silently parse to 0
+var durationFlags = []string{
+	"shutdown.timeout",
+	"sftp.upload.maxage",
+	"sftp.timeout.idle",
+	"sftp.timeout.handshake",
+	"ftp.timeout.idle",
+	"privilege.ttl",
+	"cache.ttl",
+}
+
 func main() {
 	app := &cli.App{
 		Name:     g.NAME,
@@ -22,7 +49,7 @@ func main() {
 		Compiled: time.Now(),
 		Authors:  []cli.Author{{Name: g.AUTHOR, Email: g.MAIL}},
 		Before: func(c *cli.Context) error {
-			fmt.Fprintf(c.App.Writer, util.StripIndent(
+			fmt.Fprint(c.App.Writer, util.StripIndent(
 				`
 				 ####   ####   ####     #####  #####   ####  #    # #   #
 				#    # #      #         #    # #    # #    #  #  #   # #  
@@ -40,7 +67,7 @@ func main() {
 				Usage: "start a new oss-proxy",
 				Action: func(ctx *cli.Context) error {
 					for _, flagName := range ctx.FlagNames() {
-						if ctx.String(flagName) != "" {
+						if ctx.String(flagName) != "" || optionalFlags[flagName] {
 							continue
 						}
 
@@ -48,26 +75,78 @@ func main() {
 						os.Exit(127)
 					}
 
+					for _, flagName := range durationFlags {
+						if _, err := time.ParseDuration(ctx.String(flagName)); err != nil {
+							fmt.Println(flagName + " is not a valid duration: " + err.Error())
+							os.Exit(127)
+						}
+					}
+
 					g.ParseConfig(ctx)
 					logger.InitLogger()
+					auth.InitUserStore()
+					auth.InitACL()
+					privilege.InitPrivilege()
 					sftp.InitFileSystem()
 
 					go sftp.Start()
+					go ftp.Start()
 					go http.Start()
 
-					select {}
+					signals := make(chan os.Signal, 1)
+					signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+					logger.Infof("received %s, shutting down", <-signals)
+					shutdown(g.Config().ShutdownTimeout)
+
+					return nil
 				},
 				Flags: []cli.Flag{
-					&cli.StringFlag{Name: "sftp.keypath", Value: "./id_rsa", Usage: "sftp private key file path"},
+					&cli.StringFlag{Name: "sftp.keypath", Value: "./id_rsa", Usage: "additional sftp host key file, loaded when it exists"},
+					&cli.StringFlag{Name: "sftp.keydir", Value: "./hostkeys", Usage: "directory of the sftp host keys, missing ed25519, ecdsa and rsa keys are generated there"},
 					&cli.StringFlag{Name: "sftp.host", Value: "0.0.0.0", Usage: "sftp server host"},
 					&cli.StringFlag{Name: "sftp.port", Value: "2022", Usage: "sftp server port"},
+					&cli.StringFlag{Name: "sftp.rmdir.recursive", Value: "0", Usage: "remove the content of a directory along with it instead of refusing to remove non-empty directories"},
+					&cli.StringFlag{Name: "sftp.upload.maxage", Value: "24h", Usage: "age after which unfinished uploads are removed"},
+					&cli.StringFlag{Name: "sftp.listing.meta", Value: "1", Usage: "read the mtime, mode and symlink target of every listed file, costs one HEAD request per file"},
+					&cli.StringFlag{Name: "sftp.max.conns", Value: "200", Usage: "maximum number of sftp connections, 0 for no limit"},
+					&cli.StringFlag{Name: "sftp.max.userconns", Value: "20", Usage: "maximum number of sftp connections of a user, 0 for no limit"},
+					&cli.StringFlag{Name: "sftp.max.channels", Value: "10", Usage: "maximum number of sessions open on an sftp connection, 0 for no limit"},
+					&cli.StringFlag{Name: "sftp.timeout.idle", Value: "15m", Usage: "close sftp connections whose sessions did not move any data for this long, 0 disables it"},
+					&cli.StringFlag{Name: "sftp.timeout.handshake", Value: "30s", Usage: "time an sftp client has to complete the ssh handshake and log in, 0 disables it"},
+					&cli.StringFlag{Name: "ftp.enabled", Value: "0", Usage: "start the ftp server"},
+					&cli.StringFlag{Name: "ftp.host", Value: "0.0.0.0", Usage: "ftp server host"},
+					&cli.StringFlag{Name: "ftp.port", Value: "2121", Usage: "ftp server port"},
+					&cli.StringFlag{Name: "ftp.passive.host", Usage: "address announced for passive data connections, the one the client connected to when empty"},
+					&cli.StringFlag{Name: "ftp.passive.ports", Value: "30000-30100", Usage: "range of the ports of passive data connections, 0 for any port"},
+					&cli.StringFlag{Name: "ftp.tls.cert", Value: "./ftp.crt", Usage: "certificate of AUTH TLS, a self-signed one is generated along with its key when both files are missing"},
+					&cli.StringFlag{Name: "ftp.tls.key", Value: "./ftp.key", Usage: "private key of the AUTH TLS certificate"},
+					&cli.StringFlag{Name: "ftp.tls.required", Value: "1", Usage: "refuse logins and data connections which are not protected by TLS"},
+					&cli.StringFlag{Name: "ftp.max.conns", Value: "100", Usage: "maximum number of ftp connections, 0 for no limit"},
+					&cli.StringFlag{Name: "ftp.timeout.idle", Value: "15m", Usage: "close ftp connections which did not send a command for this long, 0 disables it"},
 					&cli.StringFlag{Name: "http.host", Value: "0.0.0.0", Usage: "http server host"},
 					&cli.StringFlag{Name: "http.port", Value: "8088", Usage: "http server port"},
 					&cli.StringFlag{Name: "http.debug", Value: "0", Usage: "http server debug"},
+					&cli.StringFlag{Name: "http.jwt.secret", Usage: "HS256 secret of the bearer tokens whose subject is the user of a request, every request is refused when empty unless http.trust.header is set", EnvVar: "HTTP_JWT_SECRET"},
+					&cli.StringFlag{Name: "http.trust.header", Value: "0", Usage: "trust the X-Auth-User header of the requests when http.jwt.secret is empty, only for an api behind a gateway authenticating the users"},
+					&cli.StringFlag{Name: "storage.region", Value: "oss-cn-shenzhen", Usage: "oss region of the bucket"},
+					&cli.StringFlag{Name: "storage.endpoint", Usage: "oss endpoint replacing the one of the region"},
+					&cli.StringFlag{Name: "storage.internal", Value: "0", Usage: "reach oss through the internal network of the region"},
+					&cli.StringFlag{Name: "storage.secure", Value: "0", Usage: "talk to oss over https"},
+					&cli.StringFlag{Name: "storage.bucket", Value: "welab-ftp", Usage: "oss bucket the files are stored in"},
+					&cli.StringFlag{Name: "storage.mounts", Value: "./mounts.json", Usage: "mount table file path, maps directories onto other buckets"},
 					&cli.StringFlag{Name: "ak.id", Value: "0", Usage: "aliyun access key id", EnvVar: "AK_ID"},
 					&cli.StringFlag{Name: "ak.secret", Value: "0", Usage: "aliyun access key secret", EnvVar: "AK_SECRET"},
+					&cli.StringFlag{Name: "ak.sts", Usage: "file path or http url of sts credentials used instead of the access key", EnvVar: "AK_STS"},
+					&cli.StringFlag{Name: "auth.users", Value: "./users.json", Usage: "sftp users file path"},
+					&cli.StringFlag{Name: "auth.acl", Value: "./acl.json", Usage: "path rules file path"},
 					&cli.StringFlag{Name: "privilege.host", Usage: "privilege server host"},
 					&cli.StringFlag{Name: "privilege.port", Usage: "privilege server port"},
+					&cli.StringFlag{Name: "privilege.ttl", Value: "60s", Usage: "how long privilege decisions are cached"},
+					&cli.StringFlag{Name: "privilege.failopen", Value: "0", Usage: "allow operations when the privilege server is unreachable"},
+					&cli.StringFlag{Name: "cache.ttl", Value: "5s", Usage: "how long directory listings and stats are cached, 0 disables the cache"},
+					&cli.StringFlag{Name: "cache.size", Value: "10000", Usage: "maximum number of cached listing pages and stats"},
+					&cli.StringFlag{Name: "shutdown.timeout", Value: "60s", Usage: "time the transfers in progress get to finish on SIGTERM or SIGINT"},
 					&cli.StringFlag{Name: "log.dir", Value: "./", Usage: "the log file is written to the path"},
 					&cli.StringFlag{Name: "log.level", Value: "info", Usage: "valid levels: [debug, info, warn, error, fatal]"},
 				},
@@ -77,3 +156,30 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// shutdown stops the servers, the transfers in progress get timeout to finish
+func shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	servers := map[string]func(context.Context) error{
+		"http": http.Shutdown,
+		"sftp": sftp.Shutdown,
+		"ftp":  ftp.Shutdown,
+	}
+
+	wg := sync.WaitGroup{}
+	for name, stop := range servers {
+		wg.Add(1)
+
+		go func(name string, stop func(context.Context) error) {
+			defer wg.Done()
+			if err := stop(ctx); err != nil {
+				logger.Warnf("%s server shut down: %s", name, err)
+			}
+		}(name, stop)
+	}
+
+	wg.Wait()
+	logger.Info("oss-proxy stopped")
+}
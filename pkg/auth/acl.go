@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+var Rules *ACL
+
+// Rule grants the listed operations on the bucket paths matching Path, "**"
+// matches any number of path segments. Subjects are user names, "@group" or
+// "*" for everyone.
+type Rule struct {
+	Subjects []string `json:"subjects"`
+	Path     string   `json:"path"`
+	Allow    []Op     `json:"allow"`
+}
+
+// ACL holds the rules loaded from a JSON file. The first rule matching both
+// the user and the path decides, operations on paths no rule matches are allowed.
+type ACL struct {
+	path  string
+	rules []Rule
+	lock  sync.RWMutex
+}
+
+func InitACL() {
+	Rules = &ACL{path: g.Config().Auth.ACL}
+
+	if _, err := os.Stat(Rules.path); os.IsNotExist(err) {
+		logger.Warnf("acl file %s not found, no path rules are enforced", Rules.path)
+	} else if err := Rules.Reload(); err != nil {
+		logger.Fatal("Failed to load acl", err)
+	}
+
+	go watchFile(Rules.path, watchInterval, Rules.Reload)
+}
+
+// Reload reads the rules file again, the current rules are kept on error
+func (a *ACL) Reload() error {
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", a.path, err)
+	}
+
+	for index, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("unable to parse %s: rule %d path must be absolute", a.path, index)
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rules = rules
+	return nil
+}
+
+// Allowed reports whether user may perform op on the bucket path p
+func (a *ACL) Allowed(user *User, op Op, p string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, rule := range a.rules {
+		if !rule.applies(user) || !matchPath(rule.Path, p) {
+			continue
+		}
+
+		for _, allowed := range rule.Allow {
+			if allowed == op {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func (r Rule) applies(user *User) bool {
+	for _, subject := range r.Subjects {
+		switch {
+		case subject == "*", subject == user.Name:
+			return true
+		case strings.HasPrefix(subject, "@") && user.InGroup(subject[1:]):
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPath matches p against pattern segment by segment
+func matchPath(pattern, p string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(path.Clean(p), "/"), "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(segments); skip++ {
+				if matchSegments(pattern[1:], segments[skip:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/", "/", true},
+		{"/home", "/home", true},
+		{"/home", "/home/", true},
+		{"/home", "/home/alice", false},
+		{"/home/*", "/home/alice", true},
+		{"/home/*", "/home/alice/file", false},
+		{"/home/**", "/home", true},
+		{"/home/**", "/home/alice/dir/file", true},
+		{"/home/**", "/homes/alice", false},
+		{"/**/*.log", "/app.log", true},
+		{"/**/*.log", "/var/log/app.log", true},
+		{"/**/*.log", "/var/log/app.txt", false},
+		{"/a/**/z", "/a/z", true},
+		{"/a/**/z", "/a/b/c/z", true},
+		{"/a/**/z", "/a/b/c/z/d", false},
+		{"/home/alice", "/home/bob/../alice", true},
+	}
+
+	for _, test := range tests {
+		if got := matchPath(test.pattern, test.path); got != test.want {
+			t.Errorf("matchPath(%q, %q) = %t, want %t", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	acl := &ACL{rules: []Rule{
+		{Subjects: []string{"alice"}, Path: "/shared/**", Allow: []Op{OpRead, OpWrite, OpList}},
+		{Subjects: []string{"@ops"}, Path: "/shared/**", Allow: []Op{OpRead, OpDelete}},
+		{Subjects: []string{"*"}, Path: "/shared/**", Allow: []Op{OpRead}},
+		{Subjects: []string{"*"}, Path: "/private/**"},
+	}}
+
+	alice := &User{Name: "alice", Groups: []string{"ops"}}
+	bob := &User{Name: "bob", Groups: []string{"ops"}}
+	carol := &User{Name: "carol"}
+
+	tests := []struct {
+		user *User
+		op   Op
+		path string
+		want bool
+	}{
+		{alice, OpWrite, "/shared/file", true},
+		// the first rule matching alice decides, her group is not looked at
+		{alice, OpDelete, "/shared/file", false},
+		{bob, OpDelete, "/shared/file", true},
+		{bob, OpWrite, "/shared/file", false},
+		{carol, OpRead, "/shared/dir/file", true},
+		{carol, OpList, "/shared", false},
+		{carol, OpRead, "/private/file", false},
+		{carol, OpWrite, "/public/file", true},
+	}
+
+	for _, test := range tests {
+		if got := acl.Allowed(test.user, test.op, test.path); got != test.want {
+			t.Errorf("Allowed(%s, %s, %s) = %t, want %t", test.user.Name, test.op, test.path, got, test.want)
+		}
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oss-proxy-acl-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	acl := &ACL{path: filepath.Join(dir, "acl.json")}
+
+	tests := []struct {
+		name    string
+		content string
+		rules   int
+		wantErr bool
+	}{
+		{"valid", `[{"subjects": ["*"], "path": "/private/**"}]`, 1, false},
+		{"relative path", `[{"subjects": ["*"], "path": "private/**"}]`, 1, true},
+		{"invalid", `{"subjects": ["*"]}`, 1, true},
+		{"empty", `[]`, 0, false},
+	}
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(acl.path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := acl.Reload(); (err != nil) != test.wantErr {
+			t.Errorf("%s: Reload() error = %v, want an error: %t", test.name, err, test.wantErr)
+		}
+
+		// the rules loaded last are kept when the file is invalid
+		if len(acl.rules) != test.rules {
+			t.Errorf("%s: %d rules loaded, want %d", test.name, len(acl.rules), test.rules)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a parsed authorized_keys line with the options we enforce
+type authorizedKey struct {
+	key    ssh.PublicKey
+	from   []string
+	expiry time.Time
+}
+
+// options which restrict what the server never offers anyway
+var implicitOptions = map[string]bool{
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+}
+
+// parseAuthorizedKeys parses the content of an authorized_keys file,
+// blank lines and comments are skipped. The keys with an option we can not
+// enforce, such as command= or cert-authority, are skipped too.
+func parseAuthorizedKeys(data []byte) ([]authorizedKey, error) {
+	keys := make([]authorizedKey, 0)
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return keys, err
+		}
+
+		authKey := authorizedKey{key: key}
+		supported := true
+		for _, option := range options {
+			name, value := option, ""
+			if index := strings.Index(option, "="); index >= 0 {
+				name, value = option[:index], strings.Trim(option[index+1:], `"`)
+			}
+
+			switch name = strings.ToLower(name); {
+			case name == "from":
+				authKey.from = strings.Split(value, ",")
+			case name == "expiry-time":
+				if authKey.expiry, err = parseExpiryTime(value); err != nil {
+					return keys, err
+				}
+			case implicitOptions[name]:
+			default:
+				logger.Warnf("ignoring authorized key %s, option %s is not supported", ssh.FingerprintSHA256(key), name)
+				supported = false
+			}
+		}
+
+		if supported {
+			keys = append(keys, authKey)
+		}
+	}
+
+	return keys, nil
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] format used by OpenSSH
+func parseExpiryTime(value string) (time.Time, error) {
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+
+	return time.ParseInLocation(layout, value, time.Local)
+}
+
+// allows checks the key options against the address of the client
+func (k authorizedKey) allows(remote net.Addr) bool {
+	if !k.expiry.IsZero() && time.Now().After(k.expiry) {
+		return false
+	}
+
+	if len(k.from) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		host = remote.String()
+	}
+
+	return matchFrom(k.from, host)
+}
+
+// matchFrom implements the from="pattern-list" semantics of OpenSSH: a
+// matching negated pattern denies, otherwise any matching pattern allows
+func matchFrom(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	matched := false
+
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		ok := false
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			ok = ip != nil && network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, host)
+		}
+
+		if ok && negated {
+			return false
+		}
+
+		matched = matched || ok
+	}
+
+	return matched
+}
+
+// authorizedKeys returns the inline keys of the user followed by the ones
+// read from its authorized_keys file
+func (u *User) authorizedKeys() ([]authorizedKey, error) {
+	if u.AuthorizedKeysFile == "" {
+		return u.keys, nil
+	}
+
+	data, err := ioutil.ReadFile(u.AuthorizedKeysFile)
+	if err != nil {
+		return u.keys, err
+	}
+
+	keys, err := parseAuthorizedKeys(data)
+	return append(keys, u.keys...), err
+}
+
+func (u *User) checkKey(key ssh.PublicKey, remote net.Addr) error {
+	keys, err := u.authorizedKeys()
+	if err != nil && len(keys) == 0 {
+		return err
+	}
+
+	marshaled := key.Marshal()
+	for _, authKey := range keys {
+		if bytes.Equal(authKey.key.Marshal(), marshaled) && authKey.allows(remote) {
+			return nil
+		}
+	}
+
+	return ErrInvalidCredentials
+}
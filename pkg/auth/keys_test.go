@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// authorizedLine returns the authorized_keys line of key with options
+func authorizedLine(key ssh.PublicKey, options string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " user@host"
+	if options != "" {
+		line = options + " " + line
+	}
+
+	return line
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key := newPublicKey(t)
+
+	tests := []struct {
+		name    string
+		options string
+		want    int
+		wantErr bool
+	}{
+		{"no option", "", 1, false},
+		{"from", `from="10.0.0.0/8,*.example.com"`, 1, false},
+		{"expiry", `expiry-time="20300101"`, 1, false},
+		{"implicit restrictions", "no-pty,no-port-forwarding,no-X11-forwarding", 1, false},
+		{"command", `command="/bin/true"`, 0, false},
+		{"cert authority", "cert-authority", 0, false},
+		{"unknown option", "no-touch-required", 0, false},
+		{"invalid expiry", `expiry-time="2030"`, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := "# comment\n\n" + authorizedLine(key, test.options) + "\n"
+
+			keys, err := parseAuthorizedKeys([]byte(data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseAuthorizedKeys() error = %v, want an error: %t", err, test.wantErr)
+			}
+
+			if len(keys) != test.want {
+				t.Errorf("parseAuthorizedKeys() = %d keys, want %d", len(keys), test.want)
+			}
+		})
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	tests := []struct {
+		patterns string
+		host     string
+		want     bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"10.0.0.*", "10.0.0.2", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "192.168.0.1", false},
+		{"10.0.0.0/8,!10.0.0.66", "10.0.0.66", false},
+		{"!10.0.0.66,10.0.0.0/8", "10.0.0.65", true},
+		{"!10.0.0.66", "10.0.0.65", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"10.0.0.0/8", "gateway", false},
+	}
+
+	for _, test := range tests {
+		if got := matchFrom(strings.Split(test.patterns, ","), test.host); got != test.want {
+			t.Errorf("matchFrom(%q, %q) = %t, want %t", test.patterns, test.host, got, test.want)
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	key, other := newPublicKey(t), newPublicKey(t)
+	expired := time.Now().Add(-time.Hour).Format("200601021504")
+
+	tests := []struct {
+		name    string
+		line    string
+		key     ssh.PublicKey
+		remote  string
+		allowed bool
+	}{
+		{"authorized", authorizedLine(key, ""), key, "192.168.0.1:22", true},
+		{"other key", authorizedLine(key, ""), other, "192.168.0.1:22", false},
+		{"from allowed", authorizedLine(key, `from="192.168.0.0/16"`), key, "192.168.0.1:22", true},
+		{"from denied", authorizedLine(key, `from="192.168.0.0/16"`), key, "10.0.0.1:22", false},
+		{"expired", authorizedLine(key, `expiry-time="`+expired+`"`), key, "192.168.0.1:22", false},
+		{"unsupported option", authorizedLine(key, `command="/bin/true"`), key, "192.168.0.1:22", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parseAuthorizedKeys([]byte(test.line))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remote, err := net.ResolveTCPAddr("tcp", test.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user := &User{Name: "alice", keys: keys}
+			if err := user.checkKey(test.key, remote); (err == nil) != test.allowed {
+				t.Errorf("checkKey() = %v, want the key allowed: %t", err, test.allowed)
+			}
+		})
+	}
+}
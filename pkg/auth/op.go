@@ -0,0 +1,13 @@
+package auth
+
+// Op is an operation a user asks to perform on a path
+type Op string
+
+const (
+	OpRead   Op = "read"
+	OpWrite  Op = "write"
+	OpDelete Op = "delete"
+	OpList   Op = "list"
+	OpShare  Op = "share"
+	OpCopy   Op = "copy"
+)
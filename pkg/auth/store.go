@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var Users *Store
+
+// Store holds the users loaded from a JSON file, the file is reloaded
+// whenever it changes so that users can be added without a restart
+type Store struct {
+	path  string
+	users map[string]*User
+	lock  sync.RWMutex
+}
+
+func InitUserStore() {
+	store, err := NewStore(g.Config().Auth.Users)
+	if err != nil {
+		logger.Fatal("Failed to load users", err)
+	}
+
+	Users = store
+	go Users.Watch(watchInterval)
+}
+
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path, users: make(map[string]*User)}
+	return store, store.Reload()
+}
+
+// Reload reads the users file again, the current users are kept on error
+func (s *Store) Reload() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", s.path, err)
+	}
+
+	users := make(map[string]*User, len(list))
+	for _, user := range list {
+		if user.Name == "" {
+			return fmt.Errorf("unable to parse %s: user without name", s.path)
+		}
+
+		if _, ok := users[user.Name]; ok {
+			return fmt.Errorf("unable to parse %s: duplicate user %q", s.path, user.Name)
+		}
+
+		if user.Password != "" {
+			if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+				return fmt.Errorf("unable to parse %s: invalid password hash for %q", s.path, user.Name)
+			}
+		}
+
+		keys, err := parseAuthorizedKeys([]byte(strings.Join(user.AuthorizedKeys, "\n")))
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: invalid authorized key for %q: %s", s.path, user.Name, err)
+		}
+
+		user.keys = keys
+		users[user.Name] = user
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users = users
+	return nil
+}
+
+// Watch polls the users file and reloads it when its modification time changes
+func (s *Store) Watch(interval time.Duration) {
+	watchFile(s.path, interval, s.Reload)
+}
+
+func (s *Store) Lookup(name string) (*User, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	user, ok := s.users[name]
+	return user, ok
+}
+
+// Authenticate checks the password of the named user
+func (s *Store) Authenticate(name string, password []byte) (*User, error) {
+	user, ok := s.Lookup(name)
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := user.checkPassword(password); err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	return user, nil
+}
+
+// AuthenticateKey checks the public key offered by the named user connecting from remote
+func (s *Store) AuthenticateKey(name string, key ssh.PublicKey, remote net.Addr) (*User, error) {
+	user, ok := s.Lookup(name)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := user.checkKey(key, remote); err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	return user, nil
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUserDisabled       = errors.New("user is disabled")
+)
+
+// compared against when the user is unknown so that the time taken does not
+// reveal which users exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("oss-proxy"), bcrypt.DefaultCost)
+
+type User struct {
+	Name string `json:"name"`
+	// bcrypt hash of the password, password login is refused when empty
+	Password string `json:"password"`
+	// authorized_keys lines accepted for public key login, in addition to
+	// the ones found in AuthorizedKeysFile
+	AuthorizedKeys     []string `json:"authorized_keys,omitempty"`
+	AuthorizedKeysFile string   `json:"authorized_keys_file,omitempty"`
+	// bucket path the user is jailed to, the whole bucket when empty
+	Home     string            `json:"home,omitempty"`
+	Groups   []string          `json:"groups,omitempty"`
+	Disabled bool              `json:"disabled"`
+	Settings map[string]string `json:"settings,omitempty"`
+
+	keys []authorizedKey
+}
+
+// Setting returns the named per-user setting or def when it is not set
+func (u *User) Setting(name, def string) string {
+	if value, ok := u.Settings[name]; ok {
+		return value
+	}
+
+	return def
+}
+
+func (u *User) InGroup(group string) bool {
+	for _, name := range u.Groups {
+		if name == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *User) checkPassword(password []byte) error {
+	if u.Password == "" {
+		return ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), password); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	return nil
+}
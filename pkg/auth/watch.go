@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"os"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// how often the watched files are checked for changes
+const watchInterval = 5 * time.Second
+
+// watchFile polls path and calls reload whenever its modification time changes
+func watchFile(path string, interval time.Duration, reload func() error) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			logger.Warnf("unable to stat %s: %s", path, err)
+			continue
+		}
+
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+
+		modTime = info.ModTime()
+		if err := reload(); err != nil {
+			logger.Errorf("unable to reload %s: %s", path, err)
+			continue
+		}
+
+		logger.Infof("%s reloaded", path)
+	}
+}
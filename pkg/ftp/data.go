@@ -0,0 +1,191 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time a client has to open the data connection it asked for
+const dataTimeout = 30 * time.Second
+
+// portRange is the range of the ports of the passive data connections,
+// max is 0 for any port
+type portRange struct {
+	min, max int
+}
+
+func parsePortRange(value string) (portRange, error) {
+	if value == "" || value == "0" {
+		return portRange{}, nil
+	}
+
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return portRange{}, fmt.Errorf("%q is not a range such as 30000-30100", value)
+	}
+
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return portRange{}, fmt.Errorf("%q is not a range such as 30000-30100", value)
+	}
+
+	max, err := strconv.Atoi(bounds[1])
+	if err != nil || min <= 0 || max < min || max > 65535 {
+		return portRange{}, fmt.Errorf("%q is not a range such as 30000-30100", value)
+	}
+
+	return portRange{min: min, max: max}, nil
+}
+
+// listen opens a listener on host, on a free port of the range
+func (r portRange) listen(host string) (net.Listener, error) {
+	if r.max == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+
+	count := r.max - r.min + 1
+	start := rand.Intn(count)
+
+	var err error
+	for index := 0; index < count; index++ {
+		port := r.min + (start+index)%count
+
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return listener, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free passive port: %s", err)
+}
+
+// passiveIP returns the IPv4 address announced by PASV
+func (s *session) passiveIP() net.IP {
+	host := s.cfg.PassiveHost
+	if host == "" {
+		if addr, ok := s.raw.LocalAddr().(*net.TCPAddr); ok {
+			return addr.IP.To4()
+		}
+
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.To4()
+		}
+	}
+
+	return nil
+}
+
+// cmdPasv handles PASV and EPSV
+func (s *session) cmdPasv(extended bool) {
+	s.closePassive()
+
+	var ip net.IP
+	if !extended {
+		if ip = s.passiveIP(); ip == nil {
+			s.reply(425, "No IPv4 address to announce, use EPSV")
+			return
+		}
+	}
+
+	listener, err := s.ports.listen(s.cfg.Host)
+	if err != nil {
+		s.reply(425, "Can not open a passive connection: %s", err)
+		return
+	}
+
+	s.lock.Lock()
+	s.passive = listener
+	s.lock.Unlock()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if extended {
+		s.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+		return
+	}
+
+	s.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+}
+
+// openData accepts the data connection announced by the last PASV or EPSV
+func (s *session) openData() (net.Conn, error) {
+	s.lock.Lock()
+	listener := s.passive
+	s.passive = nil
+	s.lock.Unlock()
+
+	if listener == nil {
+		return nil, fmt.Errorf("use PASV or EPSV first")
+	}
+	defer listener.Close()
+
+	if tcp, ok := listener.(*net.TCPListener); ok {
+		tcp.SetDeadline(time.Now().Add(dataTimeout))
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the data connection must come from the client, not from a third party
+	control, _ := s.raw.RemoteAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if control == nil || remote == nil || !control.IP.Equal(remote.IP) {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s refused", conn.RemoteAddr())
+	}
+
+	if s.protect {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(dataTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	s.lock.Lock()
+	s.data = conn
+	s.lock.Unlock()
+
+	return conn, nil
+}
+
+func (s *session) closeData(conn net.Conn) {
+	s.lock.Lock()
+	s.data = nil
+	s.lock.Unlock()
+
+	conn.Close()
+}
+
+func (s *session) closePassive() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
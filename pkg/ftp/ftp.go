@@ -0,0 +1,126 @@
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/lifecycle"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// server keeps track of the sessions Shutdown has to drain
+var server = &serverState{sessions: make(map[*session]bool)}
+
+type serverState struct {
+	lifecycle.Listener
+
+	lock     sync.Mutex
+	sessions map[*session]bool
+}
+
+// add records a new session, it reports false when max sessions are open
+func (s *serverState) add(sess *session, max int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if max > 0 && len(s.sessions) >= max {
+		return false
+	}
+
+	s.sessions[sess] = true
+	return true
+}
+
+func (s *serverState) remove(sess *session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, sess)
+}
+
+func (s *serverState) transfers() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for sess := range s.sessions {
+		if sess.transferring() {
+			count++
+		}
+	}
+
+	return count
+}
+
+func Start() {
+	cfg := g.Config().Ftp
+	if !cfg.Enabled {
+		return
+	}
+
+	tlsConfig, err := loadTLSConfig(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		logger.Fatal("Failed to load the ftp certificate", err)
+	}
+
+	ports, err := parsePortRange(cfg.PassivePorts)
+	if err != nil {
+		logger.Fatal("Invalid ftp passive ports", err)
+	}
+
+	address := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logger.Fatal("failed to listen for ftp connection", err)
+	}
+
+	server.Serve("ftp", listener, func(conn net.Conn) {
+		handleConn(conn, tlsConfig, ports)
+	})
+}
+
+// handleConn serves a control connection, whatever happens to it only
+// ends that connection
+func handleConn(conn net.Conn, tlsConfig *tls.Config, ports portRange) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("ftp connection from %s panicked: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	sess := newSession(conn, tlsConfig, ports)
+	if !server.add(sess, g.Config().Ftp.MaxConns) {
+		logger.Warnf("refusing ftp connection from %s, %d connections are open", conn.RemoteAddr(), g.Config().Ftp.MaxConns)
+		sess.reply(421, "Too many connections, try again later")
+		return
+	}
+	defer server.remove(sess)
+
+	sess.serve()
+}
+
+// Shutdown stops accepting connections and lets the transfers in progress
+// finish until ctx is done, the connections are closed afterwards
+func Shutdown(ctx context.Context) error {
+	server.Stop()
+
+	err := lifecycle.Drain(ctx, server.transfers)
+	if err != nil {
+		logger.Warnf("interrupting %d ftp transfers", server.transfers())
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	for sess := range server.sessions {
+		sess.close()
+	}
+
+	return err
+}
@@ -0,0 +1,104 @@
+package ftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	sftpd "github.com/srelab/ossproxy/pkg/sftp"
+)
+
+// number of entries read from a directory lister at once
+const listPageSize = 128
+
+func (s *session) cmdList(arg string) {
+	s.list(arg, func(w io.Writer, info os.FileInfo) {
+		mode := info.Mode().String()
+		if info.Mode()&os.ModeSymlink != 0 {
+			mode = "l" + mode[1:]
+		}
+
+		modtime := info.ModTime()
+		layout := "Jan _2 15:04"
+		if time.Since(modtime) > 180*24*time.Hour || modtime.After(time.Now()) {
+			layout = "Jan _2  2006"
+		}
+
+		fmt.Fprintf(w, "%s 1 %s %s %12d %s %s\r\n", mode, s.user.Name, s.user.Name, info.Size(), modtime.Format(layout), info.Name())
+	})
+}
+
+func (s *session) cmdNlst(arg string) {
+	s.list(arg, func(w io.Writer, info os.FileInfo) {
+		fmt.Fprintf(w, "%s\r\n", info.Name())
+	})
+}
+
+func (s *session) cmdMlsd(arg string) {
+	s.list(arg, func(w io.Writer, info os.FileInfo) {
+		kind := "file"
+		if info.IsDir() {
+			kind = "dir"
+		}
+
+		fmt.Fprintf(w, "type=%s;size=%d;modify=%s; %s\r\n", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"), info.Name())
+	})
+}
+
+// list sends the entries of the directory arg refers to, or arg itself
+// when it is a file. The options of ls some clients send are ignored.
+func (s *session) list(arg string, format func(w io.Writer, info os.FileInfo)) {
+	fields := strings.Fields(arg)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+		fields = fields[1:]
+	}
+
+	p := s.path(strings.Join(fields, " "))
+
+	info, err := sftpd.Stat(s.handlers, p)
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	var lister sftp.ListerAt
+	if info.IsDir() {
+		if lister, err = s.handlers.FileList.Filelist(sftp.NewRequest("List", p)); err != nil {
+			s.reply(550, "%s: %s", p, err)
+			return
+		}
+	}
+
+	s.transfer("the listing of "+p, func(data net.Conn) error {
+		w := bufio.NewWriter(data)
+		if lister == nil {
+			format(w, info)
+			return w.Flush()
+		}
+
+		page := make([]os.FileInfo, listPageSize)
+		for offset := int64(0); ; {
+			n, err := lister.ListAt(page, offset)
+			for _, entry := range page[:n] {
+				// the object marking the directory itself is not an entry
+				if name := entry.Name(); name != "/" && name != "." && name != ".." {
+					format(w, entry)
+				}
+			}
+
+			offset += int64(n)
+			if err == io.EOF {
+				return w.Flush()
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,577 @@
+package ftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+	sftpd "github.com/srelab/ossproxy/pkg/sftp"
+)
+
+const (
+	// a connection is closed after this many failed logins
+	maxLoginFailures = 3
+	// size of the chunks uploads are written in
+	uploadBufferSize = 256 << 10
+)
+
+var errNoTransfer = errors.New("no data connection was opened")
+
+// session is the state of a control connection
+type session struct {
+	raw       net.Conn // the tcp connection, conn wraps it once TLS is on
+	conn      net.Conn
+	r         *bufio.Reader
+	cfg       *g.FtpConfig
+	tlsConfig *tls.Config
+	ports     portRange
+
+	secure   bool // the control connection is protected
+	protect  bool // PROT P, the data connections are protected
+	name     string
+	user     *auth.User
+	handlers sftp.Handlers
+	failures int
+
+	cwd        string
+	rest       int64
+	renameFrom string
+	quit       bool
+
+	busy    int32 // set while a transfer is in progress
+	lock    sync.Mutex
+	passive net.Listener
+	data    net.Conn
+}
+
+type command struct {
+	handle func(s *session, arg string)
+	login  bool // the command needs a logged in user
+}
+
+var commands = map[string]command{
+	"AUTH": {handle: (*session).cmdAuth},
+	"PBSZ": {handle: (*session).cmdPbsz},
+	"PROT": {handle: (*session).cmdProt},
+	"USER": {handle: (*session).cmdUser},
+	"PASS": {handle: (*session).cmdPass},
+	"FEAT": {handle: (*session).cmdFeat},
+	"SYST": {handle: func(s *session, arg string) { s.reply(215, "UNIX Type: L8") }},
+	"NOOP": {handle: func(s *session, arg string) { s.reply(200, "OK") }},
+	"OPTS": {handle: (*session).cmdOpts},
+	"QUIT": {handle: (*session).cmdQuit},
+
+	"PWD":  {handle: (*session).cmdPwd, login: true},
+	"XPWD": {handle: (*session).cmdPwd, login: true},
+	"CWD":  {handle: (*session).cmdCwd, login: true},
+	"XCWD": {handle: (*session).cmdCwd, login: true},
+	"CDUP": {handle: func(s *session, arg string) { s.cmdCwd("..") }, login: true},
+	"TYPE": {handle: (*session).cmdType, login: true},
+	"MODE": {handle: (*session).cmdMode, login: true},
+	"STRU": {handle: (*session).cmdStru, login: true},
+	"PASV": {handle: func(s *session, arg string) { s.cmdPasv(false) }, login: true},
+	"EPSV": {handle: func(s *session, arg string) { s.cmdPasv(true) }, login: true},
+	"REST": {handle: (*session).cmdRest, login: true},
+	"LIST": {handle: (*session).cmdList, login: true},
+	"NLST": {handle: (*session).cmdNlst, login: true},
+	"MLSD": {handle: (*session).cmdMlsd, login: true},
+	"RETR": {handle: (*session).cmdRetr, login: true},
+	"STOR": {handle: (*session).cmdStor, login: true},
+	"DELE": {handle: (*session).cmdDele, login: true},
+	"MKD":  {handle: (*session).cmdMkd, login: true},
+	"XMKD": {handle: (*session).cmdMkd, login: true},
+	"RMD":  {handle: (*session).cmdRmd, login: true},
+	"XRMD": {handle: (*session).cmdRmd, login: true},
+	"RNFR": {handle: (*session).cmdRnfr, login: true},
+	"RNTO": {handle: (*session).cmdRnto, login: true},
+	"SIZE": {handle: (*session).cmdSize, login: true},
+	"MDTM": {handle: (*session).cmdMdtm, login: true},
+}
+
+func newSession(conn net.Conn, tlsConfig *tls.Config, ports portRange) *session {
+	return &session{
+		raw:       conn,
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		cfg:       g.Config().Ftp,
+		tlsConfig: tlsConfig,
+		ports:     ports,
+		cwd:       "/",
+	}
+}
+
+func (s *session) serve() {
+	defer s.closePassive()
+
+	s.reply(220, "oss-proxy ready")
+
+	for !s.quit {
+		if s.cfg.IdleTimeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.cfg.IdleTimeout))
+		}
+
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logger.Infof("closing the idle ftp connection from %s", s.raw.RemoteAddr())
+				s.reply(421, "Idle timeout, closing the connection")
+			}
+
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		name, arg := line, ""
+		if index := strings.IndexByte(line, ' '); index >= 0 {
+			name, arg = line[:index], line[index+1:]
+		}
+
+		name = strings.ToUpper(name)
+		if name == "PASS" {
+			logger.Infof("ftp command: PASS ***")
+		} else {
+			logger.Infof("ftp command: %s", line)
+		}
+
+		cmd, ok := commands[name]
+		if !ok {
+			s.reply(502, "Command %s not implemented", name)
+			continue
+		}
+
+		if cmd.login && s.user == nil {
+			s.reply(530, "Please login with USER and PASS")
+			continue
+		}
+
+		// REST and RNFR only apply to the command following them
+		if name != "REST" && name != "RETR" && name != "STOR" {
+			s.rest = 0
+		}
+
+		if name != "RNFR" && name != "RNTO" {
+			s.renameFrom = ""
+		}
+
+		cmd.handle(s, arg)
+	}
+}
+
+// reply sends a single line reply
+func (s *session) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+// close ends the session, its transfer included
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.data != nil {
+		s.data.Close()
+	}
+
+	if s.passive != nil {
+		s.passive.Close()
+	}
+
+	s.raw.Close()
+}
+
+func (s *session) transferring() bool {
+	return atomic.LoadInt32(&s.busy) == 1
+}
+
+// path returns the request path arg refers to
+func (s *session) path(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return path.Clean(arg)
+	}
+
+	return path.Join(s.cwd, arg)
+}
+
+func (s *session) cmdAuth(arg string) {
+	switch strings.ToUpper(arg) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		s.reply(504, "AUTH %s not supported", arg)
+		return
+	}
+
+	if s.secure {
+		s.reply(503, "TLS is already on")
+		return
+	}
+
+	s.reply(234, "AUTH %s successful", arg)
+
+	conn := tls.Server(s.raw, s.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		logger.Warnf("tls handshake with %s failed: %s", s.raw.RemoteAddr(), err)
+		s.quit = true
+		return
+	}
+
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.secure = true
+}
+
+func (s *session) cmdPbsz(arg string) {
+	if !s.secure {
+		s.reply(503, "PBSZ needs AUTH TLS first")
+		return
+	}
+
+	s.reply(200, "PBSZ=0")
+}
+
+func (s *session) cmdProt(arg string) {
+	if !s.secure {
+		s.reply(503, "PROT needs AUTH TLS first")
+		return
+	}
+
+	switch strings.ToUpper(arg) {
+	case "P":
+		s.protect = true
+		s.reply(200, "Data connections are protected")
+	case "C":
+		if s.cfg.TLSRequired {
+			s.reply(534, "Data connections must be protected")
+			return
+		}
+
+		s.protect = false
+		s.reply(200, "Data connections are clear")
+	default:
+		s.reply(504, "PROT %s not supported", arg)
+	}
+}
+
+func (s *session) cmdUser(arg string) {
+	if s.cfg.TLSRequired && !s.secure {
+		s.reply(530, "Use AUTH TLS before logging in")
+		return
+	}
+
+	s.name = arg
+	s.user = nil
+	s.reply(331, "Password required for %s", arg)
+}
+
+func (s *session) cmdPass(arg string) {
+	if s.name == "" {
+		s.reply(503, "Login with USER first")
+		return
+	}
+
+	user, err := auth.Users.Authenticate(s.name, []byte(arg))
+	if err != nil {
+		logger.Warnf("ftp password rejected for %q from %s: %s", s.name, s.raw.RemoteAddr(), err)
+		s.reply(530, "Login incorrect")
+
+		if s.failures++; s.failures >= maxLoginFailures {
+			s.quit = true
+		}
+
+		return
+	}
+
+	logger.Infof("ftp user login: %s", user.Name)
+
+	s.user = user
+	s.handlers = sftpd.NewOssHandler(user)
+	s.cwd = "/"
+	s.reply(230, "User %s logged in", user.Name)
+}
+
+func (s *session) cmdFeat(arg string) {
+	fmt.Fprintf(s.conn, "211-Features:\r\n AUTH TLS\r\n PBSZ\r\n PROT\r\n EPSV\r\n PASV\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n MLST type*;size*;modify*;\r\n UTF8\r\n211 End\r\n")
+}
+
+func (s *session) cmdOpts(arg string) {
+	if strings.EqualFold(arg, "UTF8 ON") {
+		s.reply(200, "UTF8 is always on")
+		return
+	}
+
+	s.reply(501, "Option %s not supported", arg)
+}
+
+func (s *session) cmdQuit(arg string) {
+	s.reply(221, "Goodbye")
+	s.quit = true
+}
+
+func (s *session) cmdPwd(arg string) {
+	s.reply(257, "\"%s\" is the current directory", strings.Replace(s.cwd, "\"", "\"\"", -1))
+}
+
+func (s *session) cmdCwd(arg string) {
+	p := s.path(arg)
+
+	info, err := sftpd.Stat(s.handlers, p)
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	if !info.IsDir() {
+		s.reply(550, "%s: not a directory", p)
+		return
+	}
+
+	s.cwd = p
+	s.reply(250, "Directory changed to %s", p)
+}
+
+func (s *session) cmdType(arg string) {
+	switch strings.ToUpper(arg) {
+	case "A", "A N", "I", "L 8":
+		// files are always sent as they are stored
+		s.reply(200, "Type set to %s", arg)
+	default:
+		s.reply(504, "Type %s not supported", arg)
+	}
+}
+
+func (s *session) cmdMode(arg string) {
+	if strings.ToUpper(arg) != "S" {
+		s.reply(504, "Mode %s not supported", arg)
+		return
+	}
+
+	s.reply(200, "Mode set to S")
+}
+
+func (s *session) cmdStru(arg string) {
+	if strings.ToUpper(arg) != "F" {
+		s.reply(504, "Structure %s not supported", arg)
+		return
+	}
+
+	s.reply(200, "Structure set to F")
+}
+
+func (s *session) cmdRest(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		s.reply(501, "Invalid offset %s", arg)
+		return
+	}
+
+	s.rest = offset
+	s.reply(350, "Restarting at %d", offset)
+}
+
+func (s *session) cmdRetr(arg string) {
+	p := s.path(arg)
+	offset := s.rest
+	s.rest = 0
+
+	info, err := sftpd.Stat(s.handlers, p)
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	if info.IsDir() {
+		s.reply(550, "%s: not a regular file", p)
+		return
+	}
+
+	if offset > info.Size() {
+		s.reply(551, "Offset %d is beyond the end of %s", offset, p)
+		return
+	}
+
+	reader, err := s.handlers.FileGet.Fileread(sftp.NewRequest("Get", p))
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+	defer sftpd.CloseFile(reader)
+
+	s.transfer(fmt.Sprintf("%s (%d bytes)", p, info.Size()-offset), func(data net.Conn) error {
+		_, err := io.Copy(data, io.NewSectionReader(reader, offset, info.Size()-offset))
+		return err
+	})
+}
+
+func (s *session) cmdStor(arg string) {
+	p := s.path(arg)
+
+	if s.rest != 0 {
+		s.rest = 0
+		s.reply(550, "Resuming uploads is not supported")
+		return
+	}
+
+	writer, err := s.handlers.FilePut.Filewrite(sftp.NewRequest("Put", p))
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	started := s.transfer(p, func(data net.Conn) error {
+		buf := make([]byte, uploadBufferSize)
+		for offset := int64(0); ; {
+			n, err := io.ReadFull(data, buf)
+			if n > 0 {
+				if _, werr := writer.WriteAt(buf[:n], offset); werr != nil {
+					sftpd.Discard(writer, werr)
+					sftpd.CloseFile(writer)
+					return werr
+				}
+
+				offset += int64(n)
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sftpd.CloseFile(writer)
+			}
+
+			if err != nil {
+				// what was received of an interrupted upload is not stored
+				sftpd.Discard(writer, err)
+				sftpd.CloseFile(writer)
+				return err
+			}
+		}
+	})
+
+	// nothing was received, the upload is dropped along with its handle
+	if !started {
+		sftpd.Discard(writer, errNoTransfer)
+		sftpd.CloseFile(writer)
+	}
+}
+
+// transfer runs fn on a new data connection and reports how it went, it
+// returns false when fn did not run because the data connection failed
+func (s *session) transfer(what string, fn func(data net.Conn) error) bool {
+	if s.cfg.TLSRequired && !s.protect {
+		s.closePassive()
+		s.reply(521, "Data connections must be protected, use PROT P")
+		return false
+	}
+
+	atomic.StoreInt32(&s.busy, 1)
+	defer atomic.StoreInt32(&s.busy, 0)
+
+	s.reply(150, "Opening data connection for %s", what)
+
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, "Can not open data connection: %s", err)
+		return false
+	}
+
+	err = fn(data)
+	s.closeData(data)
+
+	if err != nil {
+		logger.Warnf("ftp transfer of %s for %s failed: %s", what, s.user.Name, err)
+		s.reply(426, "Transfer aborted: %s", err)
+		return true
+	}
+
+	s.reply(226, "Transfer complete")
+	return true
+}
+
+func (s *session) cmdDele(arg string) {
+	p := s.path(arg)
+	s.cmd("Remove", p, "", 250, p+" removed")
+}
+
+func (s *session) cmdMkd(arg string) {
+	p := s.path(arg)
+	s.cmd("Mkdir", p, "", 257, "\""+strings.Replace(p, "\"", "\"\"", -1)+"\" created")
+}
+
+func (s *session) cmdRmd(arg string) {
+	p := s.path(arg)
+	s.cmd("Rmdir", p, "", 250, p+" removed")
+}
+
+func (s *session) cmdRnfr(arg string) {
+	p := s.path(arg)
+	if _, err := sftpd.Stat(s.handlers, p); err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	s.renameFrom = p
+	s.reply(350, "Ready for RNTO")
+}
+
+func (s *session) cmdRnto(arg string) {
+	from := s.renameFrom
+	s.renameFrom = ""
+
+	if from == "" {
+		s.reply(503, "Use RNFR first")
+		return
+	}
+
+	to := s.path(arg)
+	s.cmd("Rename", from, to, 250, from+" renamed to "+to)
+}
+
+// cmd runs a Filecmd method on p and replies msg when it succeeds
+func (s *session) cmd(method, p, target string, code int, msg string) {
+	r := sftp.NewRequest(method, p)
+	r.Target = target
+
+	if err := s.handlers.FileCmd.Filecmd(r); err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	s.reply(code, "%s", msg)
+}
+
+func (s *session) cmdSize(arg string) {
+	p := s.path(arg)
+
+	info, err := sftpd.Stat(s.handlers, p)
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	if info.IsDir() {
+		s.reply(550, "%s: not a regular file", p)
+		return
+	}
+
+	s.reply(213, "%d", info.Size())
+}
+
+func (s *session) cmdMdtm(arg string) {
+	p := s.path(arg)
+
+	info, err := sftpd.Stat(s.handlers, p)
+	if err != nil {
+		s.reply(550, "%s: %s", p, err)
+		return
+	}
+
+	s.reply(213, "%s", info.ModTime().UTC().Format("20060102150405"))
+}
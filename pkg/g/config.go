@@ -2,6 +2,7 @@ package g
 
 import (
 	"sync"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -12,36 +13,90 @@ type LogConfig struct {
 }
 
 type SftpConfig struct {
-	Keypath string
-	Port    string
-	Host    string
+	Keypath        string
+	Keydir         string
+	Port           string
+	Host           string
+	RecursiveRmdir bool
+	UploadMaxAge   time.Duration
+	ListMeta       bool
+
+	MaxConns         int
+	MaxUserConns     int
+	MaxChannels      int
+	IdleTimeout      time.Duration
+	HandshakeTimeout time.Duration
+}
+
+type FtpConfig struct {
+	Enabled      bool
+	Host         string
+	Port         string
+	PassiveHost  string
+	PassivePorts string
+	TLSCert      string
+	TLSKey       string
+	TLSRequired  bool
+	MaxConns     int
+	IdleTimeout  time.Duration
 }
 
 type HttpConfig struct {
-	Port  string
-	Host  string
-	Debug bool
+	Port      string
+	Host      string
+	Debug     bool
+	JWTSecret string
+	// trust the user header of the requests when there is no JWT secret
+	TrustHeader bool
 }
 
 type PrivilegeConfig struct {
-	Host string
-	Port string
+	Host     string
+	Port     string
+	TTL      time.Duration
+	FailOpen bool
+}
+
+type AuthConfig struct {
+	Users string
+	ACL   string
+}
+
+type CacheConfig struct {
+	TTL  time.Duration
+	Size int
+}
+
+type StorageConfig struct {
+	Region   string
+	Endpoint string
+	Internal bool
+	Secure   bool
+	Bucket   string
+	Mounts   string
 }
 
 type AkConfig struct {
 	ID     string
 	Secret string
+	STS    string
 }
 
 type GlobalConfig struct {
 	Name    string
 	Keypath string
 
+	ShutdownTimeout time.Duration
+
 	Http      *HttpConfig
 	Sftp      *SftpConfig
+	Ftp       *FtpConfig
 	Log       *LogConfig
 	Privilege *PrivilegeConfig
 	Ak        *AkConfig
+	Auth      *AuthConfig
+	Cache     *CacheConfig
+	Storage   *StorageConfig
 }
 
 var (
@@ -57,28 +112,74 @@ func Config() *GlobalConfig {
 
 func ParseConfig(ctx *cli.Context) {
 	config = &GlobalConfig{
-		Name: NAME,
+		Name:            NAME,
+		ShutdownTimeout: ctx.Duration("shutdown.timeout"),
 		Sftp: &SftpConfig{
 			Keypath: ctx.String("sftp.keypath"),
+			Keydir:  ctx.String("sftp.keydir"),
 			Host:    ctx.String("sftp.host"),
 			Port:    ctx.String("sftp.port"),
+
+			RecursiveRmdir: ctx.Bool("sftp.rmdir.recursive"),
+			UploadMaxAge:   ctx.Duration("sftp.upload.maxage"),
+			ListMeta:       ctx.Bool("sftp.listing.meta"),
+
+			MaxConns:         ctx.Int("sftp.max.conns"),
+			MaxUserConns:     ctx.Int("sftp.max.userconns"),
+			MaxChannels:      ctx.Int("sftp.max.channels"),
+			IdleTimeout:      ctx.Duration("sftp.timeout.idle"),
+			HandshakeTimeout: ctx.Duration("sftp.timeout.handshake"),
+		},
+		Ftp: &FtpConfig{
+			Enabled:      ctx.Bool("ftp.enabled"),
+			Host:         ctx.String("ftp.host"),
+			Port:         ctx.String("ftp.port"),
+			PassiveHost:  ctx.String("ftp.passive.host"),
+			PassivePorts: ctx.String("ftp.passive.ports"),
+			TLSCert:      ctx.String("ftp.tls.cert"),
+			TLSKey:       ctx.String("ftp.tls.key"),
+			TLSRequired:  ctx.Bool("ftp.tls.required"),
+			MaxConns:     ctx.Int("ftp.max.conns"),
+			IdleTimeout:  ctx.Duration("ftp.timeout.idle"),
 		},
 		Http: &HttpConfig{
-			Debug: ctx.Bool("http.debug"),
-			Host:  ctx.String("http.host"),
-			Port:  ctx.String("http.port"),
+			Debug:     ctx.Bool("http.debug"),
+			Host:      ctx.String("http.host"),
+			Port:      ctx.String("http.port"),
+			JWTSecret: ctx.String("http.jwt.secret"),
+
+			TrustHeader: ctx.Bool("http.trust.header"),
 		},
 		Log: &LogConfig{
 			Dir:   ctx.String("log.dir"),
 			Level: ctx.String("log.level"),
 		},
 		Privilege: &PrivilegeConfig{
-			Host: ctx.String("privilege.host"),
-			Port: ctx.String("privilege.port"),
+			Host:     ctx.String("privilege.host"),
+			Port:     ctx.String("privilege.port"),
+			TTL:      ctx.Duration("privilege.ttl"),
+			FailOpen: ctx.Bool("privilege.failopen"),
 		},
 		Ak: &AkConfig{
 			ID:     ctx.String("ak.id"),
 			Secret: ctx.String("ak.secret"),
+			STS:    ctx.String("ak.sts"),
+		},
+		Auth: &AuthConfig{
+			Users: ctx.String("auth.users"),
+			ACL:   ctx.String("auth.acl"),
+		},
+		Storage: &StorageConfig{
+			Region:   ctx.String("storage.region"),
+			Endpoint: ctx.String("storage.endpoint"),
+			Internal: ctx.Bool("storage.internal"),
+			Secure:   ctx.Bool("storage.secure"),
+			Bucket:   ctx.String("storage.bucket"),
+			Mounts:   ctx.String("storage.mounts"),
+		},
+		Cache: &CacheConfig{
+			TTL:  ctx.Duration("cache.ttl"),
+			Size: ctx.Int("cache.size"),
 		},
 	}
 }
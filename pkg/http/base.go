@@ -2,8 +2,22 @@ package http
 
 import (
 	"fmt"
+	"path"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/privilege"
+)
+
+const (
+	// header carrying the user a request is made on behalf of, it is only
+	// trusted when no JWT secret is configured and http.trust.header is set
+	UserHeader = "X-Auth-User"
+	// context key the JWT middleware stores the token of a request under
+	tokenContextKey = "user"
 )
 
 type BaseResult struct {
@@ -20,6 +34,42 @@ type BaseError struct {
 }
 
 var ApiErrorParameter = BaseError{Code: 10008, Message: "Parameter error"}
+var ApiErrorPermission = BaseError{Code: 10013, Message: "Permission denied"}
+
+// requestUser returns the user a request is made on behalf of, the subject
+// of its JWT when a secret is configured, the UserHeader when it is trusted
+// and nobody otherwise
+func requestUser(ctx echo.Context) (*auth.User, bool) {
+	config := g.Config().Http
+
+	name := ""
+	if token, ok := ctx.Get(tokenContextKey).(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			name, _ = claims["sub"].(string)
+		}
+	} else if config.JWTSecret == "" && config.TrustHeader {
+		name = ctx.Request().Header.Get(UserHeader)
+	}
+
+	if name == "" {
+		return nil, false
+	}
+
+	return auth.Users.Lookup(name)
+}
+
+// Authorized checks the path rules and asks the privilege server whether the
+// user of the request may perform op on p, requests of unknown users never are
+func Authorized(ctx echo.Context, op auth.Op, p string) bool {
+	user, ok := requestUser(ctx)
+	if !ok {
+		logger.Warnf("%s refused to an unauthenticated request from %s", op, ctx.RealIP())
+		return false
+	}
+
+	p = path.Join("/", p)
+	return auth.Rules.Allowed(user, op, p) && privilege.Default.Allowed(user.Name, op, p)
+}
 
 func FailureResponse(ctx echo.Context, status int, baseError BaseError, err error, v ...interface{}) error {
 	str := ""
@@ -5,8 +5,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/denverdino/aliyungo/oss"
-	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/sftp"
 
 	"github.com/labstack/echo"
 )
@@ -42,22 +42,15 @@ func (CopyHandler) Put(ctx echo.Context) error {
 		prefix = "/"
 	}
 
-	client := oss.NewOSSClient(
-		"oss-cn-shenzhen",
-		false,
-		g.Config().Ak.ID,
-		g.Config().Ak.Secret,
-		false,
-	)
+	for _, path := range payload.Paths {
+		dst := filepath.Join("contract", prefix, path.Dst)
+		if !Authorized(ctx, auth.OpCopy, dst) {
+			result.Errors = append(result.Errors, map[string]string{"path": path.Src, "msg": ApiErrorPermission.Message})
 
-	bucket := client.Bucket("welab-ftp")
+			continue
+		}
 
-	for _, path := range payload.Paths {
-		if _, err := bucket.PutCopy(
-			filepath.Join("contract", prefix, path.Dst),
-			oss.Private, oss.CopyOptions{},
-			filepath.Join("/", payload.Bucket, path.Src),
-		); err != nil {
+		if err := sftp.Backend.Copy(payload.Bucket, strings.TrimLeft(path.Src, "/"), dst); err != nil {
 			errmsg := strings.Replace(err.Error(), "Aliyun API Error:", "", 1)
 			result.Errors = append(result.Errors, map[string]string{"path": path.Src, "msg": errmsg})
 
@@ -1,8 +1,11 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"sync"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
@@ -10,6 +13,11 @@ import (
 	"github.com/srelab/ossproxy/pkg/logger"
 )
 
+var (
+	server     *echo.Echo
+	serverLock sync.Mutex
+)
+
 func Start() {
 	e := echo.New()
 	e.Use(middleware.CORS())
@@ -24,13 +32,54 @@ func Start() {
 	e.HideBanner = true
 	e.Debug = g.Config().Http.Debug
 
+	authn := authenticator()
 	PublicHandler{}.Init(e.Group("/api/v1"))
-	SftpHandler{}.Init(e.Group("/api/v1/sftp"))
-	ShareHandler{}.Init(e.Group("/api/v1/share"))
-	CopyHandler{}.Init(e.Group("/api/v1/copy"))
+	SftpHandler{}.Init(e.Group("/api/v1/sftp", authn...))
+	ShareHandler{}.Init(e.Group("/api/v1/share", authn...))
+	CopyHandler{}.Init(e.Group("/api/v1/copy", authn...))
 
 	address := fmt.Sprintf("%s:%s", g.Config().Http.Host, g.Config().Http.Port)
-	if err := e.Start(address); err != nil {
+	serverLock.Lock()
+	server = e
+	serverLock.Unlock()
+
+	if err := e.Start(address); err != nil && err != http.ErrServerClosed {
 		log.Println(err)
 	}
 }
+
+// authenticator returns the middleware checking the bearer JWT of the
+// requests. Without a secret the UserHeader is only trusted when
+// http.trust.header is set, the api must then only be reachable through a
+// gateway which authenticates the users.
+func authenticator() []echo.MiddlewareFunc {
+	secret := g.Config().Http.JWTSecret
+	if secret == "" {
+		if g.Config().Http.TrustHeader {
+			logger.Warnf("http.jwt.secret is not set, trusting the %s header of every request", UserHeader)
+		} else {
+			logger.Errorf("neither http.jwt.secret nor http.trust.header is set, every request is refused")
+		}
+
+		return nil
+	}
+
+	return []echo.MiddlewareFunc{middleware.JWTWithConfig(middleware.JWTConfig{
+		SigningKey: []byte(secret),
+		ContextKey: tokenContextKey,
+	})}
+}
+
+// Shutdown stops accepting requests and waits for the requests being
+// served until ctx is done
+func Shutdown(ctx context.Context) error {
+	serverLock.Lock()
+	e := server
+	serverLock.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	return e.Shutdown(ctx)
+}
@@ -4,14 +4,24 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo"
+	"github.com/srelab/ossproxy/pkg/sftp"
 )
 
 type PublicHandler struct{}
 
 func (handler PublicHandler) Init(g *echo.Group) {
 	g.GET("/", handler.Get)
+	g.GET("/metrics", handler.Metrics)
 }
 
 func (PublicHandler) Get(ctx echo.Context) error {
 	return SuccessResponse(ctx, http.StatusOK, nil)
 }
+
+// Metrics reports the hit and miss counts of the metadata cache
+func (PublicHandler) Metrics(ctx echo.Context) error {
+	return SuccessResponse(ctx, http.StatusOK, &BaseResult{
+		Result:  map[string]interface{}{"cache": sftp.Cache.Stats()},
+		Success: true,
+	})
+}
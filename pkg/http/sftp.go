@@ -11,19 +11,24 @@ import (
 
 	"strconv"
 
-	"github.com/denverdino/aliyungo/oss"
 	"github.com/labstack/echo"
 	"github.com/mholt/archiver"
+	"github.com/srelab/ossproxy/pkg/auth"
 	"github.com/srelab/ossproxy/pkg/sftp"
 )
 
 type SftpHandler struct{}
+type RenamePayLoad struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
 
 func (handler SftpHandler) Init(g *echo.Group) {
 	g.GET("/*", handler.Get)
 	g.DELETE("/*", handler.Delete)
 
 	g.POST("/files/__archive", handler.Archive)
+	g.POST("/files/__rename", handler.Rename)
 }
 
 func (SftpHandler) Get(ctx echo.Context) error {
@@ -44,7 +49,11 @@ func (SftpHandler) Get(ctx echo.Context) error {
 		prefix = "/"
 	}
 
-	files, err := sftp.FileSystem.FetchFiles(prefix, recursive)
+	if !Authorized(ctx, auth.OpList, prefix) || (share != "" && !Authorized(ctx, auth.OpShare, prefix)) {
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+	}
+
+	files, err := sftp.FetchFiles(prefix, recursive)
 	if err != nil {
 		return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 			Code:    10010,
@@ -59,7 +68,7 @@ func (SftpHandler) Get(ctx echo.Context) error {
 				continue
 			}
 
-			files[fp].URL = sftp.Bucket.SignedURL(
+			files[fp].URL = sftp.Backend.SignedURL(
 				files[fp].OssPath(fp), time.Now().Add(time.Duration(expire)*time.Minute),
 			)
 		}
@@ -78,21 +87,32 @@ func (SftpHandler) Delete(ctx echo.Context) error {
 		recursive = false
 	}
 
-	files, err := sftp.FileSystem.FetchFiles(prefix, recursive)
-	foList := make([]oss.Object, 0) // need delete file object list
-	doList := make([]oss.Object, 0) // need delete directory object list
+	if !Authorized(ctx, auth.OpDelete, prefix) {
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+	}
+
+	files, err := sftp.FetchFiles(prefix, recursive)
+	for fp := range files {
+		// the rules may protect some of the children
+		if !Authorized(ctx, auth.OpDelete, fp) {
+			return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+		}
+	}
+
+	foList := make([]string, 0) // need delete file object list
+	doList := make([]string, 0) // need delete directory object list
 	for fp, file := range files {
 		key := file.OssPath(fp)
 
 		if file.Isdir {
-			doList = append(doList, oss.Object{Key: key})
+			doList = append(doList, key)
 		} else {
-			foList = append(foList, oss.Object{Key: key})
+			foList = append(foList, key)
 		}
 	}
 
 	if len(foList) > 0 {
-		if err := sftp.Bucket.DelMulti(oss.Delete{Quiet: true, Objects: foList}); err != nil {
+		if err := sftp.Backend.Delete(foList...); err != nil {
 			return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 				Code:    10011,
 				Message: "sftp internal error",
@@ -101,7 +121,7 @@ func (SftpHandler) Delete(ctx echo.Context) error {
 	}
 
 	if len(doList) > 0 {
-		if err := sftp.Bucket.DelMulti(oss.Delete{Quiet: true, Objects: doList}); err != nil {
+		if err := sftp.Backend.Delete(doList...); err != nil {
 			return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 				Code:    10011,
 				Message: "sftp internal error",
@@ -114,6 +134,33 @@ func (SftpHandler) Delete(ctx echo.Context) error {
 	})
 }
 
+func (SftpHandler) Rename(ctx echo.Context) error {
+	payload := RenamePayLoad{}
+	if err := ctx.Bind(&payload); err != nil {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+	}
+
+	if payload.Src == "" || payload.Dst == "" {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, nil)
+	}
+
+	if !Authorized(ctx, auth.OpDelete, payload.Src) || !Authorized(ctx, auth.OpWrite, payload.Dst) {
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+	}
+
+	user, _ := requestUser(ctx)
+	if err := sftp.Rename(user, payload.Src, payload.Dst); err != nil {
+		return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
+			Code:    10014,
+			Message: "sftp internal error",
+		}, err)
+	}
+
+	return SuccessResponse(ctx, http.StatusOK, &BaseResult{
+		Success: true,
+	})
+}
+
 func (SftpHandler) Archive(ctx echo.Context) error {
 	prefixes := make([]string, 0)
 	archivePaths := make([]string, 0)
@@ -130,7 +177,13 @@ func (SftpHandler) Archive(ctx echo.Context) error {
 	}
 
 	for _, prefix := range prefixes {
-		files, err := sftp.FileSystem.FetchFiles(prefix, true)
+		if !Authorized(ctx, auth.OpRead, prefix) {
+			return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+		}
+	}
+
+	for _, prefix := range prefixes {
+		files, err := sftp.FetchFiles(prefix, true)
 		if err != nil {
 			return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 				Code:    10010,
@@ -147,7 +200,7 @@ func (SftpHandler) Archive(ctx echo.Context) error {
 			tmpfp := filepath.Join(filepath.Join(localArchiveRoot, fprefix, fname))
 
 			_ = os.MkdirAll(filepath.Join(localArchiveRoot, fprefix), 0755)
-			if fd, err := sftp.Bucket.Get(fp); err == nil {
+			if fd, err := sftp.Backend.Get(file.OssPath(fp)); err == nil {
 				if err := ioutil.WriteFile(tmpfp, fd, 0644); err != nil {
 					fmt.Println(err)
 					continue
@@ -169,18 +222,16 @@ func (SftpHandler) Archive(ctx echo.Context) error {
 		}, err)
 	}
 
-	archiveData, err := ioutil.ReadFile(filepath.Join(localArchiveRoot, archiveName))
+	archiveFile, err := os.Open(filepath.Join(localArchiveRoot, archiveName))
 	if err != nil {
 		return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 			Code:    10012,
 			Message: "unable to read archive file",
 		}, err)
 	}
+	defer archiveFile.Close()
 
-	if err := sftp.Bucket.Put(
-		filepath.Join(remoteArchiveRoot, archiveName), archiveData,
-		"content-type", oss.Private, oss.Options{},
-	); err != nil {
+	if err := sftp.Upload(filepath.Join(remoteArchiveRoot, archiveName), archiveFile); err != nil {
 		return FailureResponse(ctx, http.StatusInternalServerError, BaseError{
 			Code:    10012,
 			Message: "unable to write archive file",
@@ -188,7 +239,7 @@ func (SftpHandler) Archive(ctx echo.Context) error {
 	}
 
 	return SuccessResponse(ctx, http.StatusOK, &BaseResult{
-		Result: sftp.Bucket.SignedURL(
+		Result: sftp.Backend.SignedURL(
 			filepath.Join(remoteArchiveRoot, archiveName), time.Now().Add(time.Duration(120)*time.Minute),
 		),
 		Success: true,
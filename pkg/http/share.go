@@ -9,6 +9,7 @@ import (
 	"strconv"
 
 	"github.com/labstack/echo"
+	"github.com/srelab/ossproxy/pkg/auth"
 	"github.com/srelab/ossproxy/pkg/sftp"
 )
 
@@ -30,8 +31,12 @@ func (ShareHandler) Get(ctx echo.Context) error {
 		prefix = "unknow"
 	}
 
+	if !Authorized(ctx, auth.OpShare, prefix) {
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorPermission, nil)
+	}
+
 	return SuccessResponse(ctx, http.StatusOK, &BaseResult{
-		Result:  sftp.Bucket.SignedURL(prefix, time.Now().Add(time.Duration(expire)*time.Minute)),
+		Result:  sftp.Backend.SignedURL(prefix, time.Now().Add(time.Duration(expire)*time.Minute)),
 		Success: true,
 	})
 }
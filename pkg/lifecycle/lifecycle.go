@@ -0,0 +1,112 @@
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/srelab/common/color"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+const (
+	// bounds of the delay before accepting connections again after a
+	// temporary error, such as running out of file descriptors
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+	// how often Drain checks whether the transfers are over
+	drainInterval = 100 * time.Millisecond
+)
+
+// Listener is the listener of a server, it is closed once the server
+// starts shutting down
+type Listener struct {
+	lock     sync.Mutex
+	listener net.Listener
+	closing  bool
+}
+
+// listen records the listener Stop closes, it reports false once the
+// server is shutting down
+func (l *Listener) listen(listener net.Listener) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.listener = listener
+	return !l.closing
+}
+
+// IsClosing reports whether the server is shutting down
+func (l *Listener) IsClosing() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.closing
+}
+
+// Stop marks the server as shutting down and closes its listener
+func (l *Listener) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closing = true
+	if l.listener != nil {
+		l.listener.Close()
+	}
+}
+
+// Serve hands the connections accepted on listener to handle, each in its
+// own goroutine, until Stop is called
+func (l *Listener) Serve(name string, listener net.Listener, handle func(net.Conn)) {
+	if !l.listen(listener) {
+		listener.Close()
+		return
+	}
+
+	color.Printf("⇨ %s server started on %s\n", name, color.Green(listener.Addr()))
+
+	backoff := time.Duration(0)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if l.IsClosing() {
+				return
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff *= 2; backoff == 0 {
+					backoff = acceptBackoffMin
+				} else if backoff > acceptBackoffMax {
+					backoff = acceptBackoffMax
+				}
+
+				logger.Warnf("failed to accept incoming %s connection, retrying in %s: %s", name, backoff, err)
+				time.Sleep(backoff)
+
+				continue
+			}
+
+			logger.Fatal("failed to accept incoming "+name+" connection", err)
+		}
+
+		backoff = 0
+		go handle(conn)
+	}
+}
+
+// Drain returns once pending reports no transfer or ctx is done
+func Drain(ctx context.Context, pending func() int) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l Listener
+	handled := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		l.Serve("test", listener, func(conn net.Conn) {
+			conn.Close()
+			handled <- struct{}{}
+		})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-handled
+
+	l.Stop()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Serve still accepts connections after Stop")
+	}
+
+	if !l.IsClosing() {
+		t.Error("IsClosing() = false after Stop")
+	}
+}
+
+func TestServeAfterStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l Listener
+	l.Stop()
+	l.Serve("test", listener, func(conn net.Conn) { t.Error("connection handled after Stop") })
+
+	if _, err := listener.Accept(); err == nil {
+		t.Error("the listener is still open")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var pending int32 = 2
+	go func() {
+		for atomic.LoadInt32(&pending) > 0 {
+			time.Sleep(drainInterval / 2)
+			atomic.AddInt32(&pending, -1)
+		}
+	}()
+
+	count := func() int { return int(atomic.LoadInt32(&pending)) }
+	if err := Drain(context.Background(), count); err != nil || count() != 0 {
+		t.Errorf("Drain() = %v with %d transfers pending", err, count())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainInterval)
+	defer cancel()
+
+	if err := Drain(ctx, func() int { return 1 }); err != context.DeadlineExceeded {
+		t.Errorf("Drain() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -14,7 +14,8 @@ import (
 )
 
 var (
-	logger *log.Logger
+	// the logs go to the standard output until InitLogger is called
+	logger = log.New(g.NAME)
 )
 
 const (
@@ -0,0 +1,152 @@
+package privilege
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+const (
+	requestTimeout = 5 * time.Second
+	// time the privilege server is not asked again after a failed request
+	failureBackoff = 10 * time.Second
+	// the expired decisions are swept once the cache grows past this size
+	maxCachedDecisions = 10000
+)
+
+var Default *Checker
+
+// Checker asks the privilege server whether a user may perform an operation
+// on a path and caches the answers for a while
+type Checker struct {
+	baseURL  string
+	ttl      time.Duration
+	failOpen bool
+	client   *http.Client
+
+	decisions map[string]decision
+	downUntil time.Time // set after a failed request
+	lock      sync.Mutex
+}
+
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+type privilegeResult struct {
+	Result struct {
+		Allowed bool `json:"allowed"`
+	} `json:"result"`
+	Success bool `json:"success"`
+}
+
+func InitPrivilege() {
+	Default = New(
+		fmt.Sprintf("http://%s:%s", g.Config().Privilege.Host, g.Config().Privilege.Port),
+		g.Config().Privilege.TTL,
+		g.Config().Privilege.FailOpen,
+	)
+}
+
+// New returns a Checker talking to the privilege server at baseURL, when the
+// server can not be reached the operations are allowed only if failOpen is set
+func New(baseURL string, ttl time.Duration, failOpen bool) *Checker {
+	return &Checker{
+		baseURL:   baseURL,
+		ttl:       ttl,
+		failOpen:  failOpen,
+		client:    &http.Client{Timeout: requestTimeout},
+		decisions: make(map[string]decision),
+	}
+}
+
+// Allowed reports whether user may perform op on the bucket path
+func (c *Checker) Allowed(user string, op auth.Op, path string) bool {
+	key := user + "\x00" + string(op) + "\x00" + path
+
+	c.lock.Lock()
+	cached, ok := c.decisions[key]
+	c.lock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.allowed
+	}
+
+	// while the privilege server is down every check would wait for the
+	// request timeout, they get the fail mode answer straight away instead
+	if c.isDown() {
+		return c.failOpen
+	}
+
+	allowed, err := c.query(user, op, path)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		logger.Errorf("privilege check of %s %s %s failed, not asking again for %s: %s", user, op, path, failureBackoff, err)
+		c.downUntil = time.Now().Add(failureBackoff)
+		return c.failOpen
+	}
+
+	if len(c.decisions) >= maxCachedDecisions {
+		c.sweep()
+	}
+
+	c.decisions[key] = decision{allowed: allowed, expires: time.Now().Add(c.ttl)}
+	return allowed
+}
+
+func (c *Checker) isDown() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return time.Now().Before(c.downUntil)
+}
+
+func (c *Checker) query(user string, op auth.Op, path string) (bool, error) {
+	params := url.Values{"user": {user}, "op": {string(op)}, "path": {path}}
+
+	resp, err := c.client.Get(c.baseURL + "/api/v1/privilege?" + params.Encode())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("privilege server answered %s", resp.Status)
+	}
+
+	result := privilegeResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+
+	if !result.Success {
+		return false, fmt.Errorf("privilege server reported a failure")
+	}
+
+	return result.Result.Allowed, nil
+}
+
+// sweep drops the expired decisions, or all of them when none expired yet
+func (c *Checker) sweep() {
+	now := time.Now()
+	for key, cached := range c.decisions {
+		if now.After(cached.expires) {
+			delete(c.decisions, key)
+		}
+	}
+
+	if len(c.decisions) >= maxCachedDecisions {
+		c.decisions = make(map[string]decision)
+	}
+}
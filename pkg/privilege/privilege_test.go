@@ -0,0 +1,125 @@
+package privilege
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/auth"
+)
+
+// privilegeServer stands in for the privilege server, it allows the read
+// operations only and counts the requests it gets
+func privilegeServer(t *testing.T, status int) (*httptest.Server, *int32) {
+	count := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+
+		if r.URL.Path != "/api/v1/privilege" {
+			t.Errorf("unexpected request of %s", r.URL.Path)
+		}
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		allowed := r.URL.Query().Get("op") == string(auth.OpRead)
+		fmt.Fprintf(w, `{"result": {"allowed": %t}, "success": true}`, allowed)
+	}))
+
+	return server, count
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failOpen bool
+		op       auth.Op
+		want     bool
+	}{
+		{"allowed", http.StatusOK, false, auth.OpRead, true},
+		{"denied", http.StatusOK, true, auth.OpWrite, false},
+		{"server error fails closed", http.StatusInternalServerError, false, auth.OpRead, false},
+		{"server error fails open", http.StatusInternalServerError, true, auth.OpWrite, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := privilegeServer(t, test.status)
+			defer server.Close()
+
+			checker := New(server.URL, time.Minute, test.failOpen)
+			if got := checker.Allowed("alice", test.op, "/home/alice/file"); got != test.want {
+				t.Errorf("Allowed() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAllowedCachesDecisions(t *testing.T) {
+	server, count := privilegeServer(t, http.StatusOK)
+	defer server.Close()
+
+	checker := New(server.URL, time.Minute, false)
+	for i := 0; i < 3; i++ {
+		checker.Allowed("alice", auth.OpRead, "/home/alice/file")
+		checker.Allowed("alice", auth.OpWrite, "/home/alice/file")
+	}
+
+	if got := atomic.LoadInt32(count); got != 2 {
+		t.Errorf("privilege server asked %d times, want 2", got)
+	}
+}
+
+func TestAllowedExpiresDecisions(t *testing.T) {
+	server, count := privilegeServer(t, http.StatusOK)
+	defer server.Close()
+
+	checker := New(server.URL, time.Millisecond, false)
+	checker.Allowed("alice", auth.OpRead, "/home/alice/file")
+	time.Sleep(5 * time.Millisecond)
+	checker.Allowed("alice", auth.OpRead, "/home/alice/file")
+
+	if got := atomic.LoadInt32(count); got != 2 {
+		t.Errorf("privilege server asked %d times, want 2", got)
+	}
+}
+
+func TestAllowedBacksOffAfterFailure(t *testing.T) {
+	server, count := privilegeServer(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	checker := New(server.URL, time.Minute, true)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if !checker.Allowed("alice", auth.OpRead, path) {
+			t.Errorf("Allowed(%s) = false while failing open", path)
+		}
+	}
+
+	if got := atomic.LoadInt32(count); got != 1 {
+		t.Errorf("privilege server asked %d times while down, want 1", got)
+	}
+}
+
+func TestAllowedUnreachable(t *testing.T) {
+	server, _ := privilegeServer(t, http.StatusOK)
+	server.Close()
+
+	checker := New(server.URL, time.Minute, false)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if checker.Allowed("alice", auth.OpRead, fmt.Sprintf("/file%d", i)) {
+			t.Fatal("Allowed() = true while failing closed")
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > requestTimeout {
+		t.Errorf("checks took %s while the privilege server was down", elapsed)
+	}
+}
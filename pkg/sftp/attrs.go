@@ -0,0 +1,265 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/storage"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// user metadata keys the attributes set by Setstat are stored under
+	metaMtime = "mtime"
+	metaMode  = "mode"
+	// number of objects whose metadata is fetched at the same time
+	metaWorkers = 16
+)
+
+// flags of the attributes of a Setstat request, see draft-ietf-secsh-filexfer-02
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+)
+
+// fileAttrs are the attributes a client asked to set
+type fileAttrs struct {
+	flags uint32
+	size  uint64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// parseAttrs decodes the attributes of a Setstat request
+func parseAttrs(flags uint32, b []byte) (*fileAttrs, error) {
+	attrs := &fileAttrs{flags: flags}
+
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, sftp.ErrSshFxBadMessage
+		}
+
+		field := b[:n]
+		b = b[n:]
+		return field, nil
+	}
+
+	if flags&attrSize != 0 {
+		field, err := next(8)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs.size = binary.BigEndian.Uint64(field)
+	}
+
+	if flags&attrUIDGID != 0 {
+		if _, err := next(8); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&attrPermissions != 0 {
+		field, err := next(4)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs.mode = os.FileMode(binary.BigEndian.Uint32(field)).Perm()
+	}
+
+	if flags&attrACModTime != 0 {
+		field, err := next(8)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs.mtime = time.Unix(int64(binary.BigEndian.Uint32(field[4:])), 0)
+	}
+
+	return attrs, nil
+}
+
+// marshal encodes the attributes the way a Setstat request carries them
+func (attrs *fileAttrs) marshal() []byte {
+	b := make([]byte, 28)
+	n := 0
+
+	if attrs.flags&attrSize != 0 {
+		binary.BigEndian.PutUint64(b[n:], attrs.size)
+		n += 8
+	}
+
+	if attrs.flags&attrUIDGID != 0 {
+		n += 8
+	}
+
+	if attrs.flags&attrPermissions != 0 {
+		binary.BigEndian.PutUint32(b[n:], uint32(attrs.mode))
+		n += 4
+	}
+
+	if attrs.flags&attrACModTime != 0 {
+		binary.BigEndian.PutUint32(b[n:], uint32(attrs.mtime.Unix()))
+		binary.BigEndian.PutUint32(b[n+4:], uint32(attrs.mtime.Unix()))
+		n += 8
+	}
+
+	return b[:n]
+}
+
+// setstat stores the mtime and the mode of p in the metadata of its object,
+// the size of a file can not be changed
+func (fs *filesystem) setstat(p, fullpath string, attrs *fileAttrs) error {
+	file, err := fs.fetch(p)
+	if err != nil {
+		return err
+	}
+
+	fs.filesLock.Lock()
+	w := fs.writers[p]
+	fs.filesLock.Unlock()
+
+	if attrs.flags&attrSize != 0 && w == nil && !file.Isdir && int64(attrs.size) != file.Fsize {
+		return sftp.ErrSshFxOpUnsupported
+	}
+
+	if attrs.flags&(attrPermissions|attrACModTime) == 0 {
+		return nil
+	}
+
+	changes := make(map[string]string, 2)
+	if attrs.flags&attrPermissions != 0 {
+		changes[metaMode] = strconv.FormatUint(uint64(attrs.mode), 8)
+	}
+
+	if attrs.flags&attrACModTime != 0 {
+		changes[metaMtime] = strconv.FormatInt(attrs.mtime.Unix(), 10)
+	}
+
+	if w != nil {
+		// the object of a file being uploaded does not exist yet
+		for name, value := range changes {
+			w.setMeta(name, value)
+		}
+	} else if err := fs.updateMeta(file.OssPath(fullpath), changes); err != nil {
+		if err == os.ErrNotExist && file.Isdir {
+			// an implicit directory has no object to hold the attributes
+			return nil
+		}
+
+		return err
+	}
+
+	updated := *file
+	updated.applyMeta(changes)
+	fs.store(p, &updated)
+	return nil
+}
+
+// updateMeta merges changes into the metadata of key
+func (fs *filesystem) updateMeta(key string, changes map[string]string) error {
+	object, err := fs.backend.Head(key)
+	if err != nil {
+		return err
+	}
+
+	meta := make(map[string]string, len(object.Meta)+len(changes))
+	for name, value := range object.Meta {
+		meta[name] = value
+	}
+
+	for name, value := range changes {
+		meta[name] = value
+	}
+
+	return fs.backend.SetMeta(key, meta)
+}
+
+// stat returns p with the attributes stored in the metadata of its object
+func (fs *filesystem) stat(p, fullpath string, file *memFile) (*memFile, error) {
+	if p == "/" {
+		return file, nil
+	}
+
+	object, err := fs.backend.Head(file.OssPath(fullpath))
+	if err == os.ErrNotExist && file.Isdir {
+		return file, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat := *file
+	stat.applyMeta(object.Meta)
+	return &stat, nil
+}
+
+// applyMeta sets the mtime and the mode found in the metadata of the object
+func (f *memFile) applyMeta(meta map[string]string) {
+	if value, ok := meta[metaMtime]; ok {
+		if mtime, err := strconv.ParseInt(value, 10, 64); err == nil {
+			f.Modtime = FTime(time.Unix(mtime, 0))
+		}
+	}
+
+	if value, ok := meta[metaSymlink]; ok {
+		f.Symlink = value
+	}
+
+	if value, ok := meta[metaMode]; ok {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+			f.Fmode = os.FileMode(mode).Perm()
+		}
+	}
+}
+
+// loadMeta applies the metadata of the objects of the files among entries
+func loadMeta(backend storage.Backend, entries []fileEntry) error {
+	var (
+		firstErr error
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	jobs := make(chan *fileEntry)
+	for i := 0; i < metaWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for entry := range jobs {
+				object, err := backend.Head(entry.key)
+				if err == nil {
+					entry.file.applyMeta(object.Meta)
+					continue
+				}
+
+				lock.Lock()
+				if firstErr == nil && err != os.ErrNotExist {
+					firstErr = err
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for index := range entries {
+		if !entries[index].file.Isdir {
+			jobs <- &entries[index]
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,151 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+func TestAttrsRoundTrip(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+
+	tests := []*fileAttrs{
+		{},
+		{flags: attrSize, size: 1 << 40},
+		{flags: attrPermissions, mode: 0640},
+		{flags: attrACModTime, mtime: mtime},
+		{flags: attrSize | attrPermissions | attrACModTime, size: 42, mode: 0755, mtime: mtime},
+	}
+
+	for _, attrs := range tests {
+		parsed, err := parseAttrs(attrs.flags, attrs.marshal())
+		if err != nil {
+			t.Errorf("parseAttrs(%+v) failed: %s", attrs, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed, attrs) {
+			t.Errorf("parseAttrs(marshal(%+v)) = %+v", attrs, parsed)
+		}
+	}
+
+	if _, err := parseAttrs(attrSize|attrACModTime, make([]byte, 12)); err == nil {
+		t.Error("parseAttrs() of truncated attributes succeeded")
+	}
+}
+
+// setstat sends the Setstat request of a client setting the mode and the
+// mtime of p
+func setstat(fs *filesystem, p string, mode os.FileMode, mtime time.Time) error {
+	attrs := &fileAttrs{flags: attrPermissions | attrACModTime, mode: mode, mtime: mtime}
+
+	r := sftp.NewRequest("Setstat", p)
+	r.Flags = attrs.flags
+	r.Attrs = attrs.marshal()
+
+	return fs.Filecmd(r)
+}
+
+func TestSetstat(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	want := map[string]string{metaMode: "600", metaMtime: "1500000000"}
+
+	tests := []struct {
+		name     string
+		existing bool
+		upload   bool
+	}{
+		{"stored file", true, false},
+		{"file being replaced", true, true},
+		{"new file being uploaded", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := storage.NewMemoryBackend()
+			if test.existing {
+				backend.Put("dir/file", []byte("old"))
+			}
+			backend.Put("dir/", nil)
+
+			fs := newFileSystem(backend, nil)
+
+			var w io.WriterAt
+			if test.upload {
+				var err error
+				if w, err = fs.Filewrite(sftp.NewRequest("Put", "/dir/file")); err != nil {
+					t.Fatal(err)
+				}
+
+				w.WriteAt([]byte("new"), 0)
+			}
+
+			if err := setstat(fs, "/dir/file", 0600, mtime); err != nil {
+				t.Fatalf("Setstat failed: %s", err)
+			}
+
+			if w != nil {
+				if err := CloseFile(w); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			object, err := backend.Head("dir/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(object.Meta, want) {
+				t.Errorf("meta = %v, want %v", object.Meta, want)
+			}
+		})
+	}
+}
+
+func TestListAttrs(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+
+	backend := storage.NewMemoryBackend()
+	backend.Put("dir/", nil)
+	backend.Put("dir/file", []byte("data"))
+
+	fs := newFileSystem(backend, nil)
+	fs.listMeta = true
+
+	if err := setstat(fs, "/dir/file", 0600, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.symlink("/dir/file", "/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	lister, err := fs.Filelist(sftp.NewRequest("List", "/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := make([]os.FileInfo, 10)
+	n, err := lister.ListAt(infos, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	modes := make(map[string]os.FileMode)
+	for _, info := range infos[:n] {
+		modes[info.Name()] = info.Mode()
+		if info.Name() == "file" && !info.ModTime().Equal(mtime) {
+			t.Errorf("file listed with mtime %s, want %s", info.ModTime(), mtime)
+		}
+	}
+
+	want := map[string]os.FileMode{"file": 0600, "link": os.ModeSymlink | 0777}
+	if !reflect.DeepEqual(modes, want) {
+		t.Errorf("listed modes %v, want %v", modes, want)
+	}
+}
@@ -5,27 +5,32 @@ package sftp
 // works as a very simple filesystem with simple flat key-value lookup system.
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/srelab/ossproxy/pkg/auth"
 	"github.com/srelab/ossproxy/pkg/g"
+	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/privilege"
+	"github.com/srelab/ossproxy/pkg/storage"
 
-	"github.com/denverdino/aliyungo/oss"
-	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 )
 
-var Client *oss.Client
-var Bucket *oss.Bucket
-var FileSystem *filesystem
+var Backend storage.Backend
+
+// Mounts spreads the paths of Backend over the buckets of the mount table
+var Mounts *storage.MountBackend
+
+// Cache holds the metadata of Backend, the writes made through Backend keep it up to date
+var Cache *storage.CachedBackend
 
 type FTime time.Time
 
@@ -34,49 +39,173 @@ func (t FTime) MarshalJSON() ([]byte, error) {
 	return []byte(ts), nil
 }
 
-// Implements os.FileInfo, Reader and Writer interfaces.
-// These are the 3 interfaces necessary for the Handlers.
+// Implements os.FileInfo and hands out the ReaderAt and WriterAt
+// necessary for the Handlers.
 type memFile struct {
-	Fname       string `json:"name"`
-	Modtime     FTime  `json:"modtime"`
-	Symlink     string `json:"symlink,omitempty"`
-	Isdir       bool   `json:"isdir"`
-	Fsize       int64  `json:"size"`
-	URL         string `json:"url,omitempty"`
-	Hide        bool   `json:"hide"`
-	content     []byte
-	contentLock sync.RWMutex
+	Fname   string `json:"name"`
+	Modtime FTime  `json:"modtime"`
+	Symlink string `json:"symlink,omitempty"`
+	Isdir   bool   `json:"isdir"`
+	Fsize   int64  `json:"size"`
+	URL     string `json:"url,omitempty"`
+	Hide    bool   `json:"hide"`
+	// permissions set by Setstat, zero when none were set
+	Fmode os.FileMode `json:"-"`
 }
 
-// In memory file-system-y thing that the Hanlders live on
+// In memory file-system-y thing that the Hanlders live on, every session has
+// its own. files holds the entries of the directories the session looked at,
+// filesLock guards the map only and is never held across an OSS call.
 type filesystem struct {
 	*memFile
+	backend   storage.Backend
+	user      *auth.User
+	home      string // bucket path every request path is jailed to
 	files     map[string]*memFile
 	filesLock sync.Mutex
 	mockErr   error
+	// whether Rmdir also removes the content of the directory
+	recursiveRmdir bool
+	// whether listings read the attributes and symlink targets of the files
+	listMeta bool
+	// uploads in progress, Setstat hands them the attributes of their file
+	writers map[string]*uploadWriter
 }
 
 func InitFileSystem() {
-	Client = oss.NewOSSClient(
-		"oss-cn-shenzhen",
-		false,
-		g.Config().Ak.ID,
-		g.Config().Ak.Secret,
-		false,
-	)
+	storageConfig := g.Config().Storage
+	creds := storage.Credentials{AccessKeyID: g.Config().Ak.ID, AccessKeySecret: g.Config().Ak.Secret}
+
+	var source storage.CredentialSource
+	if g.Config().Ak.STS != "" {
+		source = storage.NewCredentialSource(g.Config().Ak.STS)
+
+		fetched, err := source()
+		if err != nil {
+			logger.Fatal("Failed to fetch sts credentials", err)
+		}
+
+		creds = *fetched
+	}
 
-	Bucket = Client.Bucket("welab-ftp")
+	client := storage.NewOSSClient(storageConfig.Region, storageConfig.Endpoint, storageConfig.Internal, storageConfig.Secure, creds)
+	backends := []storage.Backend{storage.NewOSSBackend(client.Bucket(storageConfig.Bucket))}
+	Mounts = storage.NewMountBackend(backends[0])
 
-	FileSystem = &filesystem{
-		files: make(map[string]*memFile),
+	if _, err := os.Stat(storageConfig.Mounts); os.IsNotExist(err) {
+		logger.Infof("mount table %s not found, every path lives in %s", storageConfig.Mounts, storageConfig.Bucket)
+	} else {
+		mounts, err := storage.LoadMounts(storageConfig.Mounts)
+		if err != nil {
+			logger.Fatal("Failed to load mount table", err)
+		}
+
+		for _, mount := range mounts {
+			region := mount.Region
+			if region == "" {
+				region = storageConfig.Region
+			}
+
+			client := storage.NewOSSClient(region, mount.Endpoint, mount.Internal, mount.Secure, creds)
+			backend := storage.NewOSSBackend(client.Bucket(mount.Bucket))
+
+			backends = append(backends, backend)
+			Mounts.Mount(mount.Path, backend)
+			logger.Infof("%s mounted on bucket %s in %s", mount.Path, mount.Bucket, region)
+		}
 	}
 
-	FileSystem.memFile = newMemFile("/", true, true, 0, time.Now())
+	if source != nil {
+		go storage.RefreshCredentials(source, creds, backends...)
+	}
+
+	Cache = storage.NewCachedBackend(Mounts, g.Config().Cache.TTL, g.Config().Cache.Size)
+	Backend = Cache
+
+	go janitor(Backend, g.Config().Sftp.UploadMaxAge)
+}
+
+// FetchFiles lists the files under prefix on the whole bucket
+func FetchFiles(prefix string, recursive bool) (map[string]*memFile, error) {
+	return newFileSystem(Backend, nil).FetchFiles(prefix, recursive)
 }
 
-// NewHandler returns a Hanlders object with the test handlers.
-func NewOssHandler() sftp.Handlers {
-	return sftp.Handlers{FileGet: FileSystem, FilePut: FileSystem, FileCmd: FileSystem, FileList: FileSystem}
+// Rename moves the file or the whole directory src to dst on the whole
+// bucket, every object moved is authorized for user unless it is nil
+func Rename(user *auth.User, src, dst string) error {
+	fs := newFileSystem(Backend, nil)
+	fs.user = user
+
+	return fs.rename(path.Clean("/"+src), path.Clean("/"+dst))
+}
+
+// newFileSystem returns a filesystem acting on behalf of user, a nil user
+// sees the whole bucket and is not subject to authorization
+func newFileSystem(backend storage.Backend, user *auth.User) *filesystem {
+	home := "/"
+	if user != nil {
+		home = path.Clean("/" + user.Home)
+	}
+
+	return &filesystem{
+		memFile: newMemFile("/", true, true, 0, time.Now()),
+		backend: backend,
+		user:    user,
+		home:    home,
+		files:   make(map[string]*memFile),
+		writers: make(map[string]*uploadWriter),
+	}
+}
+
+// NewOssHandler returns the Hanlders of a connection jailed to the home of the user.
+func NewOssHandler(user *auth.User) sftp.Handlers {
+	fs := newFileSystem(Backend, user)
+	fs.recursiveRmdir = g.Config().Sftp.RecursiveRmdir
+	fs.listMeta = g.Config().Sftp.ListMeta
+
+	return newGuardedHandlers(fs)
+}
+
+// authorize checks the path rules and asks the privilege server whether the
+// user may perform op on the bucket path
+func (fs *filesystem) authorize(op auth.Op, fullpath string) error {
+	if fs.user == nil {
+		return nil
+	}
+
+	if auth.Rules.Allowed(fs.user, op, fullpath) && privilege.Default.Allowed(fs.user.Name, op, fullpath) {
+		return nil
+	}
+
+	logger.Warnf("%s denied to %s on %s", op, fs.user.Name, fullpath)
+	return sftp.ErrSshFxPermissionDenied
+}
+
+// authorizeTree checks op on the bucket path of every key, one denied key
+// is enough to refuse an operation on a whole tree
+func (fs *filesystem) authorizeTree(op auth.Op, keys []string) error {
+	if fs.user == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := fs.authorize(op, "/"+strings.TrimSuffix(key, "/")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolve translates a request path into the bucket path it refers to,
+// ".." can not climb above the home of the filesystem
+func (fs *filesystem) resolve(p string) (string, error) {
+	full := path.Join(fs.home, path.Clean("/"+p))
+	if full != fs.home && !strings.HasPrefix(full, strings.TrimRight(fs.home, "/")+"/") {
+		return "", sftp.ErrSshFxPermissionDenied
+	}
+
+	return full, nil
 }
 
 // Example Handlers
@@ -85,27 +214,34 @@ func (fs *filesystem) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 		return nil, fs.mockErr
 	}
 
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
-
-	file, err := fs.fetch(r.Filepath)
+	fullpath, err := fs.resolve(r.Filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	if file.Symlink != "" {
-		file, err = fs.fetch(file.Symlink)
-		if err != nil {
+	if err := fs.authorize(auth.OpRead, fullpath); err != nil {
+		return nil, err
+	}
+
+	file, err := fs.fetch(r.Filepath)
+	if err == os.ErrNotExist {
+		if err := fs.refresh(filepath.Dir(r.Filepath)); err != nil {
 			return nil, err
 		}
+
+		file, err = fs.fetch(r.Filepath)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	content, err := Bucket.Get(file.OssPath(r.Filepath))
+	file, fullpath, err = fs.follow(auth.OpRead, r.Filepath, fullpath, file)
 	if err != nil {
 		return nil, err
 	}
 
-	return file.ReaderAt(content)
+	return file.ReaderAt(fs.backend, file.OssPath(fullpath))
 }
 
 func (fs *filesystem) Filewrite(r *sftp.Request) (io.WriterAt, error) {
@@ -113,25 +249,68 @@ func (fs *filesystem) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, fs.mockErr
 	}
 
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+	fullpath, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.authorize(auth.OpWrite, fullpath); err != nil {
+		return nil, err
+	}
 
 	file, err := fs.fetch(r.Filepath)
 	if err == os.ErrNotExist {
-		dir, err := fs.fetch(filepath.Dir(r.Filepath))
-		if err != nil {
+		if err := fs.refresh(filepath.Dir(r.Filepath)); err != nil {
 			return nil, err
 		}
 
-		if !dir.Isdir {
-			return nil, os.ErrInvalid
+		file, err = fs.fetch(r.Filepath)
+	}
+
+	if err == os.ErrNotExist {
+		if err := fs.checkDir(filepath.Dir(r.Filepath)); err != nil {
+			return nil, err
 		}
 
 		file = newMemFile(r.Filepath, false, false, 0, time.Now())
-		fs.files[r.Filepath] = file
+		fs.store(r.Filepath, file)
+	} else if err != nil {
+		return nil, err
+	}
+
+	w, err := file.WriterAt(fs.backend, file.OssPath(fullpath))
+	if err != nil {
+		return nil, err
+	}
+
+	fs.filesLock.Lock()
+	fs.writers[r.Filepath] = w
+	fs.filesLock.Unlock()
+
+	w.onClose = func() {
+		fs.filesLock.Lock()
+		defer fs.filesLock.Unlock()
+
+		if fs.writers[r.Filepath] == w {
+			delete(fs.writers, r.Filepath)
+		}
+
+		// the size and mtime of the entry are the ones before the upload
+		delete(fs.files, r.Filepath)
 	}
 
-	return file.WriterAt()
+	return w, nil
+}
+
+// operation each Filecmd method is authorized as, a rename also needs
+// write access to its target and a symlink write access to the link
+var cmdOps = map[string]auth.Op{
+	"Setstat": auth.OpWrite,
+	"Rename":  auth.OpDelete,
+	"Rmdir":   auth.OpDelete,
+	"Remove":  auth.OpDelete,
+	"Mkdir":   auth.OpWrite,
+	"Symlink": auth.OpRead,
 }
 
 func (fs *filesystem) Filecmd(r *sftp.Request) error {
@@ -139,70 +318,65 @@ func (fs *filesystem) Filecmd(r *sftp.Request) error {
 		return fs.mockErr
 	}
 
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+	fullpath, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.authorize(cmdOps[r.Method], fullpath); err != nil {
+		return err
+	}
 
 	// Update the OSS file list with the requested file path
-	if files, err := fs.FetchFiles(filepath.Dir(r.Filepath), false); err == nil {
-		fs.files = files
-	} else {
+	if err := fs.refresh(filepath.Dir(r.Filepath)); err != nil {
 		return err
 	}
 
 	switch r.Method {
 	case "Setstat":
-		return nil
-	case "Rename":
-		file, err := fs.fetch(r.Filepath)
+		attrs, err := parseAttrs(r.Flags, r.Attrs)
 		if err != nil {
 			return err
 		}
 
-		if _, ok := fs.files[r.Target]; ok {
-			return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target,
-				Err: fmt.Errorf("dest file exists")}
-		}
-
-		// Copy
-		target := file.OssPath(r.Target)
-		source := Bucket.Path(file.OssPath(r.Filepath))
-		if _, err := Bucket.PutCopy(target, oss.Private, oss.CopyOptions{}, source); err != nil {
+		return fs.setstat(r.Filepath, fullpath, attrs)
+	case "Rename":
+		target, err := fs.resolve(r.Target)
+		if err != nil {
 			return err
 		}
 
-		if err := Bucket.Del(file.OssPath(r.Filepath)); err != nil {
+		if err := fs.authorize(auth.OpWrite, target); err != nil {
 			return err
 		}
 
-		file.Fname = filepath.Base(r.Target)
-		fs.files[r.Target] = file
-
-		delete(fs.files, r.Filepath)
-	case "Rmdir", "Remove":
-		file, err := fs.fetch(r.Filepath)
-		if err != nil {
+		return fs.rename(r.Filepath, r.Target)
+	case "Rmdir":
+		return fs.rmdir(r.Filepath, fullpath)
+	case "Remove":
+		return fs.remove(r.Filepath, fullpath)
+	case "Mkdir":
+		if err := fs.checkDir(filepath.Dir(r.Filepath)); err != nil {
 			return err
 		}
 
-		if err := Bucket.Del(file.OssPath(r.Filepath)); err != nil {
+		dirPath := strings.TrimLeft(fullpath, "/") + "/"
+		if err := fs.backend.Put(dirPath, []byte{}); err != nil {
 			return err
 		}
 
-		delete(fs.files, r.Filepath)
-	case "Mkdir":
-		_, err := fs.fetch(filepath.Dir(r.Filepath))
+		fs.store(r.Filepath, newMemFile(filepath.Base(r.Filepath), true, false, 0, time.Now()))
+	case "Symlink":
+		link, err := fs.resolve(r.Target)
 		if err != nil {
 			return err
 		}
 
-		dirPath := strings.TrimLeft(r.Filepath, "/") + "/"
-		if err := Bucket.Put(dirPath, []byte{}, "content-type", oss.Private, oss.Options{}); err != nil {
+		if err := fs.authorize(auth.OpWrite, link); err != nil {
 			return err
 		}
 
-		fs.files[r.Filepath] = newMemFile(filepath.Base(r.Filepath), true, false, 0, time.Now())
-	case "Symlink":
-		return errors.New("Protocol error.")
+		return fs.symlink(r.Filepath, r.Target)
 	}
 
 	return nil
@@ -227,57 +401,22 @@ func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 
 func (fs *filesystem) FetchFiles(prefix string, recursive bool) (files map[string]*memFile, err error) {
 	files = make(map[string]*memFile, 0)
-	prefix = strings.TrimLeft(prefix+"/", "/")
-
-	max := 1000
-	delim := "/"
-	if recursive {
-		delim = ""
-	}
-
-	resp2files := func(resp *oss.ListResp) {
-		for _, content := range resp.Contents {
-			modtime, err := time.Parse(time.RFC3339, content.LastModified)
-			if err != nil {
-				modtime = time.Now()
-			}
-
-			path := filepath.Join("/", strings.TrimRight(content.Key, "/"))
-			fn := filepath.Base(path)
 
-			if strings.HasSuffix(content.Key, "/") {
-				files[path] = newMemFile(fn, true, true, content.Size, modtime)
-			} else {
-				files[path] = newMemFile(fn, false, false, content.Size, modtime)
-			}
-
-			files[path].Fsize = content.Size
+	iter := newFileIterator(fs.backend, fs.home, prefix, recursive)
+	for {
+		entries, err := iter.Next()
+		if err == io.EOF {
+			return files, nil
 		}
 
-		for _, commonPrefix := range resp.CommonPrefixes {
-			path := filepath.Join("/", strings.TrimRight(commonPrefix, "/"))
-			fn := filepath.Base(path)
-
-			files[path] = newMemFile(fn, true, false, 0, time.Now())
+		if err != nil {
+			return files, err
 		}
-	}
-
-	resp, err := Bucket.List(prefix, delim, "", max)
-	if err != nil {
-		return files, fmt.Errorf("unable to get list of oss files: %s", err)
-	}
 
-	resp2files(resp)
-	for resp.IsTruncated {
-		fmt.Println(resp.IsTruncated, resp.NextMarker)
-		resp, err = Bucket.List(prefix, delim, resp.NextMarker, max)
-
-		if err != nil {
-			return files, fmt.Errorf("unable to get list of oss files: %s", err)
+		for _, entry := range entries {
+			files[entry.path] = entry.file
 		}
 	}
-
-	return files, err
 }
 
 func (fs *filesystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
@@ -285,38 +424,24 @@ func (fs *filesystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		return nil, fs.mockErr
 	}
 
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+	fullpath, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.authorize(auth.OpList, fullpath); err != nil {
+		return nil, err
+	}
 
 	switch r.Method {
 	case "List":
-		// Update the OSS file list with the requested file path
-		if files, err := fs.FetchFiles(r.Filepath, false); err == nil {
-			fs.files = files
-		} else {
-			return nil, err
-		}
+		iter := newFileIterator(fs.backend, fs.home, r.Filepath, false)
+		iter.withMeta = fs.listMeta
 
-		var paths []string
-		for fp := range fs.files {
-			if filepath.Dir(fp) == r.Filepath {
-				paths = append(paths, fp)
-			}
-		}
-
-		sort.Strings(paths)
-		files := make([]os.FileInfo, len(paths))
-
-		for index, fp := range paths {
-			files[index] = fs.files[fp]
-		}
-
-		return listerat(files), nil
+		return newDirLister(iter, r.Filepath), nil
 	case "Stat":
 		// Update the OSS file list with the requested file path
-		if files, err := fs.FetchFiles(filepath.Dir(r.Filepath), false); err == nil {
-			fs.files = files
-		} else {
+		if err := fs.refresh(filepath.Dir(r.Filepath)); err != nil {
 			return nil, err
 		}
 
@@ -325,12 +450,15 @@ func (fs *filesystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 			return nil, err
 		}
 
+		file, _, err = fs.follow(auth.OpList, r.Filepath, fullpath, file)
+		if err != nil {
+			return nil, err
+		}
+
 		return listerat([]os.FileInfo{file}), nil
 	case "Readlink":
 		// Update the OSS file list with the requested file path
-		if files, err := fs.FetchFiles(filepath.Dir(r.Filepath), false); err == nil {
-			fs.files = files
-		} else {
+		if err := fs.refresh(filepath.Dir(r.Filepath)); err != nil {
 			return nil, err
 		}
 
@@ -339,14 +467,16 @@ func (fs *filesystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 			return nil, err
 		}
 
-		if file.Symlink != "" {
-			file, err = fs.fetch(file.Symlink)
-			if err != nil {
-				return nil, err
-			}
+		file, err = fs.stat(r.Filepath, fullpath, file)
+		if err != nil {
+			return nil, err
 		}
 
-		return listerat([]os.FileInfo{file}), nil
+		if file.Symlink == "" {
+			return nil, &os.PathError{Op: "readlink", Path: r.Filepath, Err: syscall.EINVAL}
+		}
+
+		return listerat([]os.FileInfo{&linkInfo{memFile: file, target: file.Symlink}}), nil
 	}
 	return nil, nil
 }
@@ -362,6 +492,9 @@ func (fs *filesystem) fetch(path string) (*memFile, error) {
 		return fs.memFile, nil
 	}
 
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
 	if file, ok := fs.files[path]; ok {
 		return file, nil
 	}
@@ -369,6 +502,117 @@ func (fs *filesystem) fetch(path string) (*memFile, error) {
 	return nil, os.ErrNotExist
 }
 
+// refresh lists dir and replaces what the session knows about its entries,
+// the listing happens before the lock is taken. The files being uploaded
+// are kept, a new one is not listed until its upload completes.
+func (fs *filesystem) refresh(dir string) error {
+	files, err := fs.FetchFiles(dir, false)
+	if err != nil {
+		return err
+	}
+
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	for fp := range fs.files {
+		if filepath.Dir(fp) == dir && fs.writers[fp] == nil {
+			delete(fs.files, fp)
+		}
+	}
+
+	for fp, file := range files {
+		fs.files[fp] = file
+	}
+
+	return nil
+}
+
+// checkDir returns nil when dir is a directory, either known to the session
+// or found on the backend as a marker or as the prefix of other keys
+func (fs *filesystem) checkDir(dir string) error {
+	if file, err := fs.fetch(dir); err == nil {
+		if !file.Isdir {
+			return os.ErrInvalid
+		}
+
+		return nil
+	}
+
+	fullpath, err := fs.resolve(dir)
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.Trim(fullpath, "/") + "/"
+	if prefix == "/" {
+		return nil
+	}
+
+	if _, err := fs.backend.Head(prefix); !os.IsNotExist(err) {
+		return err
+	}
+
+	result, err := fs.backend.List(prefix, "", "", 1)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Objects) == 0 && len(result.Prefixes) == 0 {
+		return os.ErrNotExist
+	}
+
+	return nil
+}
+
+// isDir tells whether p is a directory the user may write to, the user does
+// not need to be allowed to list it
+func (fs *filesystem) isDir(p string) (bool, error) {
+	fullpath, err := fs.resolve(p)
+	if err != nil {
+		return false, err
+	}
+
+	if err := fs.authorize(auth.OpWrite, fullpath); err != nil {
+		return false, err
+	}
+
+	switch err := fs.checkDir(p); err {
+	case nil:
+		return true, nil
+	case os.ErrNotExist, os.ErrInvalid:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (fs *filesystem) store(path string, file *memFile) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	fs.files[path] = file
+}
+
+func (fs *filesystem) forget(path string) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	delete(fs.files, path)
+}
+
+// forgetTree forgets dir and everything the session knows below it
+func (fs *filesystem) forgetTree(dir string) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	delete(fs.files, dir)
+	for fp := range fs.files {
+		if strings.HasPrefix(fp, dir+"/") {
+			delete(fs.files, fp)
+		}
+	}
+}
+
 // factory to make sure modtime is set
 func newMemFile(name string, isdir bool, hide bool, size int64, modtime time.Time) *memFile {
 	return &memFile{
@@ -386,7 +630,13 @@ func (f *memFile) Size() int64  { return f.Fsize }
 func (f *memFile) Mode() os.FileMode {
 	ret := os.FileMode(0644)
 	if f.Isdir {
-		ret = os.FileMode(0755) | os.ModeDir
+		ret = os.FileMode(0755)
+	}
+	if f.Fmode != 0 {
+		ret = f.Fmode
+	}
+	if f.Isdir {
+		ret |= os.ModeDir
 	}
 	if f.Symlink != "" {
 		ret = os.FileMode(0777) | os.ModeSymlink
@@ -407,34 +657,25 @@ func (f *memFile) OssPath(path string) string {
 }
 
 // Read/Write
-func (f *memFile) ReaderAt(content []byte) (io.ReaderAt, error) {
+func (f *memFile) ReaderAt(backend storage.Backend, key string) (io.ReaderAt, error) {
 	if f.Isdir {
 		return nil, os.ErrInvalid
 	}
-	return bytes.NewReader(content), nil
-}
 
-func (f *memFile) WriterAt() (io.WriterAt, error) {
-	if f.Isdir {
-		return nil, os.ErrInvalid
+	// the size the session knows may be stale, the reads must not go past
+	// the end of the object as it is now
+	object, err := backend.Head(key)
+	if err != nil {
+		return nil, err
 	}
 
-	return f, nil
+	return newRangeReader(backend, key, object.Size), nil
 }
 
-func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
-	f.contentLock.Lock()
-	defer f.contentLock.Unlock()
-
-	plen := len(p) + int(off)
-	if plen >= len(f.content) {
-		nc := make([]byte, plen)
-		copy(nc, f.content)
-		f.content = nc
+func (f *memFile) WriterAt(backend storage.Backend, key string) (*uploadWriter, error) {
+	if f.Isdir {
+		return nil, os.ErrInvalid
 	}
 
-	copy(f.content[off:], p)
-
-	Bucket.Put(f.Fname, f.content, "content-type", oss.Private, oss.Options{})
-	return len(p), nil
+	return newUploadWriter(backend, key), nil
 }
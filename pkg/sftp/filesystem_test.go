@@ -0,0 +1,54 @@
+package sftp
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+func TestImplicitDirectory(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   error
+	}{
+		{"write", "Put", "/a/new", "a/new", nil},
+		{"mkdir", "Mkdir", "/a/b", "a/b/", nil},
+		{"write into a nested directory", "Put", "/a/c/new", "a/c/new", nil},
+		{"write into a missing directory", "Put", "/missing/new", "missing/new", os.ErrNotExist},
+		{"mkdir into a missing directory", "Mkdir", "/missing/b", "missing/b/", os.ErrNotExist},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a/ and a/c/ only exist as the prefix of the objects below them
+			backend := storage.NewMemoryBackend()
+			backend.Put("a/c/x", []byte("x"))
+
+			fs := newFileSystem(backend, nil)
+			r := sftp.NewRequest(test.method, test.path)
+
+			var err error
+			if test.method == "Mkdir" {
+				err = fs.Filecmd(r)
+			} else {
+				w, werr := fs.Filewrite(r)
+				if err = werr; err == nil {
+					err = CloseFile(w)
+				}
+			}
+
+			if err != test.want {
+				t.Fatalf("%s %s = %v, want %v", test.method, test.path, err, test.want)
+			}
+
+			if _, err := backend.Head(test.key); (err == nil) != (test.want == nil) {
+				t.Errorf("Head(%s) = %v after %s", test.key, err, test.method)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package sftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+
+	xed25519 "golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKey generates a host key of the given ssh key type
+type hostKey struct {
+	keyType  string
+	generate func() (*pem.Block, error)
+}
+
+// host keys generated in the key directory when they are missing
+var hostKeyGenerators = map[string]hostKey{
+	"ssh_host_ed25519_key": {keyType: ssh.KeyAlgoED25519, generate: func() (*pem.Block, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, err
+	}},
+	"ssh_host_ecdsa_key": {keyType: ssh.KeyAlgoECDSA256, generate: func() (*pem.Block, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalECPrivateKey(key)
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, err
+	}},
+	"ssh_host_rsa_key": {keyType: ssh.KeyAlgoRSA, generate: func() (*pem.Block, error) {
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return nil, err
+		}
+
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	}},
+}
+
+// loadHostKeys returns the key of the legacy keypath when it exists and the
+// keys of dir, the missing ones of which are generated. A server has a
+// single key of each type, the legacy one wins since clients pinned it.
+func loadHostKeys(dir, keypath string) ([]ssh.Signer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	signers := make([]ssh.Signer, 0)
+	if _, err := os.Stat(keypath); err == nil {
+		signer, err := readHostKey(keypath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load host key %s: %s", keypath, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	for name, key := range hostKeyGenerators {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); !os.IsNotExist(err) || hasKeyType(signers, key.keyType) {
+			continue
+		}
+
+		if err := writeHostKey(file, key.generate); err != nil {
+			return nil, fmt.Errorf("unable to generate %s: %s", file, err)
+		}
+
+		logger.Infof("generated host key %s", file)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	for _, file := range files {
+		if strings.HasSuffix(file, ".pub") || file == filepath.Clean(keypath) {
+			continue
+		}
+
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+
+		signer, err := readHostKey(file)
+		if err != nil {
+			logger.Warnf("skipping host key %s: %s", file, err)
+			continue
+		}
+
+		if keyType := signer.PublicKey().Type(); hasKeyType(signers, keyType) {
+			logger.Warnf("skipping host key %s: another %s key is loaded already", file, keyType)
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no host key found in %s", dir)
+	}
+
+	return signers, nil
+}
+
+func hasKeyType(signers []ssh.Signer, keyType string) bool {
+	for _, signer := range signers {
+		if signer.PublicKey().Type() == keyType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeHostKey stores a new private key in file and its public key next to it
+func writeHostKey(file string, generate func() (*pem.Block, error)) error {
+	block, err := generate()
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(block)
+	signer, err := parseHostKey(data)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+func readHostKey(file string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHostKey(data)
+}
+
+// parseHostKey parses a PEM encoded private key, PKCS#8 ed25519 keys which
+// the ssh package does not know about included
+func parseHostKey(data []byte) (ssh.Signer, error) {
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PRIVATE KEY" {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if edkey, ok := key.(ed25519.PrivateKey); ok {
+			key = xed25519.PrivateKey(edkey)
+		}
+
+		return ssh.NewSignerFromKey(key)
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
@@ -0,0 +1,117 @@
+package sftp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// connLimiter counts the connections open overall and per user, a limit
+// of 0 disables the matching check
+type connLimiter struct {
+	max     int
+	perUser int
+
+	lock  sync.Mutex
+	total int
+	users map[string]int
+}
+
+func newConnLimiter(max, perUser int) *connLimiter {
+	return &connLimiter{max: max, perUser: perUser, users: make(map[string]int)}
+}
+
+// open reserves a connection slot, it must be released with close
+func (l *connLimiter) open() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+
+	l.total++
+	return true
+}
+
+func (l *connLimiter) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+}
+
+// login reserves a slot of user, it must be released with logout
+func (l *connLimiter) login(user string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.perUser > 0 && l.users[user] >= l.perUser {
+		return false
+	}
+
+	l.users[user]++
+	return true
+}
+
+func (l *connLimiter) logout(user string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.users[user]--; l.users[user] <= 0 {
+		delete(l.users, user)
+	}
+}
+
+// activity records when the sessions of a connection last moved data
+type activity struct {
+	last int64 // unix nanoseconds
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// activeChannel is a session channel whose reads and writes count as activity
+type activeChannel struct {
+	ssh.Channel
+	activity *activity
+}
+
+func (c *activeChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.activity.touch()
+	return n, err
+}
+
+func (c *activeChannel) Write(p []byte) (int, error) {
+	c.activity.touch()
+	return c.Channel.Write(p)
+}
+
+// closeIdle closes conn once its sessions did not move any data for
+// timeout, until done is closed
+func closeIdle(conn ssh.Conn, a *activity, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if a.idle() >= timeout {
+				logger.Infof("closing the connection of %s from %s, idle for %s", conn.User(), conn.RemoteAddr(), timeout)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
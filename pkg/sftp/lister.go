@@ -0,0 +1,176 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+// maximum number of keys returned by a single List call
+const listPageSize = 1000
+
+type fileEntry struct {
+	path string
+	key  string
+	file *memFile
+}
+
+// fileIterator walks over the keys under a prefix one List page at a time,
+// the paths it returns are relative to root
+type fileIterator struct {
+	backend storage.Backend
+	root    string
+	prefix  string
+	delim   string
+	marker  string
+	done    bool
+	// whether the attributes and symlink targets are read for every file
+	withMeta bool
+}
+
+func newFileIterator(backend storage.Backend, root, dir string, recursive bool) *fileIterator {
+	delim := "/"
+	if recursive {
+		delim = ""
+	}
+
+	return &fileIterator{
+		backend: backend,
+		root:    root,
+		prefix:  strings.TrimLeft(path.Join(root, dir)+"/", "/"),
+		delim:   delim,
+	}
+}
+
+// Next returns the entries of the next page sorted by path,
+// io.EOF is returned once every page has been consumed
+func (it *fileIterator) Next() ([]fileEntry, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+
+	resp, err := it.backend.List(it.prefix, it.delim, it.marker, listPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get list of oss files: %s", err)
+	}
+
+	it.marker = resp.NextMarker
+	it.done = !resp.IsTruncated || resp.NextMarker == ""
+
+	entries := make([]fileEntry, 0, len(resp.Objects)+len(resp.Prefixes))
+	for _, content := range resp.Objects {
+		if isTempKey(content.Key) {
+			continue
+		}
+
+		fp := it.relative(content.Key)
+		isdir := strings.HasSuffix(content.Key, "/")
+
+		entries = append(entries, fileEntry{
+			path: fp,
+			key:  content.Key,
+			file: newMemFile(filepath.Base(fp), isdir, isdir, content.Size, content.ModTime),
+		})
+	}
+
+	for _, commonPrefix := range resp.Prefixes {
+		if isTempKey(commonPrefix) {
+			continue
+		}
+
+		fp := it.relative(commonPrefix)
+
+		entries = append(entries, fileEntry{
+			path: fp,
+			key:  commonPrefix,
+			file: newMemFile(filepath.Base(fp), true, false, 0, time.Now()),
+		})
+	}
+
+	if it.withMeta {
+		if err := loadMeta(it.backend, entries); err != nil {
+			return nil, fmt.Errorf("unable to get metadata of oss files: %s", err)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, nil
+}
+
+// relative returns the path of key below root
+func (it *fileIterator) relative(key string) string {
+	fp := path.Join("/", strings.TrimRight(key, "/"))
+	return path.Join("/", strings.TrimPrefix(fp, it.root))
+}
+
+// dirLister is a sftp.ListerAt fetching the pages lazily as the client reads
+// through the directory, only the entries not yet returned are kept around
+type dirLister struct {
+	iter   *fileIterator
+	dir    string
+	files  []os.FileInfo
+	offset int64 // offset of files[0] in the directory
+	lock   sync.Mutex
+}
+
+func newDirLister(iter *fileIterator, dir string) *dirLister {
+	return &dirLister{iter: iter, dir: dir}
+}
+
+func (l *dirLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if offset < l.offset {
+		return 0, fmt.Errorf("unable to list %s backwards", l.dir)
+	}
+
+	for {
+		if skip := offset - l.offset; skip > 0 {
+			if skip > int64(len(l.files)) {
+				skip = int64(len(l.files))
+			}
+
+			l.files = l.files[skip:]
+			l.offset += skip
+		}
+
+		if l.offset == offset && len(l.files) >= len(ls) {
+			break
+		}
+
+		entries, err := l.iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range entries {
+			if filepath.Dir(entry.path) == l.dir {
+				l.files = append(l.files, entry.file)
+			}
+		}
+	}
+
+	if l.offset != offset {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l.files)
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package sftp
+
+import (
+	"io"
+	"sync"
+
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+// size of the window fetched from the backend by a single ranged GET
+const readAheadSize = 4 << 20
+
+// rangeReader implements io.ReaderAt on top of ranged GETs, only one
+// read-ahead window is buffered so memory use does not depend on the file size
+type rangeReader struct {
+	backend storage.Backend
+	key     string
+	size    int64
+
+	buf    []byte
+	offset int64 // offset of buf in the object
+	lock   sync.Mutex
+}
+
+func newRangeReader(backend storage.Backend, key string, size int64) *rangeReader {
+	return &rangeReader{backend: backend, key: key, size: size}
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := 0
+	for n < len(p) && off < r.size {
+		if off < r.offset || off >= r.offset+int64(len(r.buf)) {
+			if err := r.fill(off); err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(p[n:], r.buf[off-r.offset:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fill replaces the buffered window with the one starting at off
+func (r *rangeReader) fill(off int64) error {
+	length := r.size - off
+	if length > readAheadSize {
+		length = readAheadSize
+	}
+
+	body, err := r.backend.GetRange(r.key, off, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if int64(cap(r.buf)) < length {
+		r.buf = make([]byte, length)
+	}
+
+	buf := r.buf[:length]
+	if _, err := io.ReadFull(body, buf); err != nil {
+		r.buf = r.buf[:0]
+		return err
+	}
+
+	r.buf = buf
+	r.offset = off
+	return nil
+}
@@ -0,0 +1,198 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// recovered logs the panic of a goroutine serving a client, it must be
+// deferred directly. It reports whether there was a panic.
+func recovered(what string) bool {
+	r := recover()
+	if r == nil {
+		return false
+	}
+
+	logger.Errorf("%s panicked: %v\n%s", what, r, debug.Stack())
+	return true
+}
+
+// guard turns the panic of a request handler into a failure sent to the
+// client, it must be deferred directly
+func guard(what string, err *error) {
+	if r := recover(); r != nil {
+		logger.Errorf("%s panicked: %v\n%s", what, r, debug.Stack())
+		*err = sftp.ErrSshFxFailure
+	}
+}
+
+// guardedHandlers wraps the handlers of a filesystem, the request server
+// calls them from its own goroutines where a panic would end the process
+type guardedHandlers struct {
+	fs *filesystem
+}
+
+func newGuardedHandlers(fs *filesystem) sftp.Handlers {
+	h := &guardedHandlers{fs: fs}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *guardedHandlers) Fileread(r *sftp.Request) (reader io.ReaderAt, err error) {
+	defer guard(r.Method+" "+r.Filepath, &err)
+
+	// the transfers started now would only be interrupted by Shutdown
+	if server.IsClosing() {
+		return nil, errShutdown
+	}
+
+	if reader, err = h.fs.Fileread(r); err != nil {
+		return nil, err
+	}
+
+	server.open(nil)
+	return &guardedReader{reader: reader, name: r.Filepath}, nil
+}
+
+func (h *guardedHandlers) Filewrite(r *sftp.Request) (writer io.WriterAt, err error) {
+	defer guard(r.Method+" "+r.Filepath, &err)
+
+	if server.IsClosing() {
+		return nil, errShutdown
+	}
+
+	if writer, err = h.fs.Filewrite(r); err != nil {
+		return nil, err
+	}
+
+	upload, _ := writer.(*uploadWriter)
+	server.open(upload)
+
+	return &guardedWriter{writer: writer, upload: upload, name: r.Filepath}, nil
+}
+
+func (h *guardedHandlers) Filecmd(r *sftp.Request) (err error) {
+	defer guard(r.Method+" "+r.Filepath, &err)
+
+	return h.fs.Filecmd(r)
+}
+
+func (h *guardedHandlers) isDir(p string) (dir bool, err error) {
+	defer guard("isDir "+p, &err)
+
+	return h.fs.isDir(p)
+}
+
+func (h *guardedHandlers) Filelist(r *sftp.Request) (lister sftp.ListerAt, err error) {
+	defer guard(r.Method+" "+r.Filepath, &err)
+
+	if lister, err = h.fs.Filelist(r); err != nil {
+		return nil, err
+	}
+
+	return &guardedLister{lister: lister, name: r.Filepath}, nil
+}
+
+type guardedReader struct {
+	reader io.ReaderAt
+	name   string
+	closed sync.Once
+}
+
+func (g *guardedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	defer guard("read of "+g.name, &err)
+
+	return g.reader.ReadAt(p, off)
+}
+
+func (g *guardedReader) Close() (err error) {
+	defer guard("close of "+g.name, &err)
+
+	g.closed.Do(func() { server.close(nil) })
+
+	if closer, ok := g.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+type guardedWriter struct {
+	writer io.WriterAt
+	upload *uploadWriter
+	name   string
+	closed sync.Once
+}
+
+func (g *guardedWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	defer guard("write of "+g.name, &err)
+
+	return g.writer.WriteAt(p, off)
+}
+
+func (g *guardedWriter) fail(err error) {
+	if g.upload != nil {
+		g.upload.fail(err)
+	}
+}
+
+func (g *guardedWriter) Close() (err error) {
+	defer guard("close of "+g.name, &err)
+	defer g.closed.Do(func() { server.close(g.upload) })
+
+	if closer, ok := g.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Discard makes the upload of a file opened through the handlers of
+// NewOssHandler fail, closing it aborts the upload instead of storing it
+func Discard(writer io.WriterAt, err error) {
+	failFile(writer, err)
+}
+
+// CloseFile closes what the handlers returned for a transfer
+func CloseFile(file interface{}) error {
+	if closer, ok := file.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Stat returns the attributes of p through the handlers, the way a Stat
+// request of a client gets them
+func Stat(handlers sftp.Handlers, p string) (os.FileInfo, error) {
+	lister, err := handlers.FileList.Filelist(sftp.NewRequest("Stat", p))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 1)
+	if n, err := lister.ListAt(infos, 0); n == 0 {
+		if err == nil || err == io.EOF {
+			err = os.ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	return infos[0], nil
+}
+
+type guardedLister struct {
+	lister sftp.ListerAt
+	name   string
+}
+
+func (g *guardedLister) ListAt(entries []os.FileInfo, off int64) (n int, err error) {
+	defer guard("listing of "+g.name, &err)
+
+	return g.lister.ListAt(entries, off)
+}
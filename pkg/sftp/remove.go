@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/logger"
+
+	"github.com/pkg/sftp"
+)
+
+// rmdir removes the directory p, fullpath being its bucket path. A directory
+// with children is only removed, along with them, in recursive mode.
+func (fs *filesystem) rmdir(p, fullpath string) error {
+	if fullpath == fs.home {
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	file, err := fs.fetch(p)
+	if err != nil {
+		return err
+	}
+
+	if !file.Isdir {
+		return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	prefix := file.OssPath(fullpath)
+	if fs.recursiveRmdir {
+		objects, err := listTree(fs.backend, prefix)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, len(objects))
+		for index, object := range objects {
+			keys[index] = object.Key
+		}
+
+		// the rules may protect some of the children
+		if err := fs.authorizeTree(auth.OpDelete, keys); err != nil {
+			return err
+		}
+
+		if err := fs.backend.Delete(keys...); err != nil {
+			return err
+		}
+
+		fs.forgetTree(p)
+		fs.keepParent(fullpath)
+		return nil
+	}
+
+	// the marker of the directory and at most one child
+	resp, err := fs.backend.List(prefix, "", "", 2)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Objects) == 0 {
+		fs.forget(p)
+		return os.ErrNotExist
+	}
+
+	for _, object := range resp.Objects {
+		if object.Key != prefix {
+			return &os.PathError{Op: "rmdir", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if err := fs.backend.Delete(prefix); err != nil {
+		return err
+	}
+
+	fs.forget(p)
+	fs.keepParent(fullpath)
+	return nil
+}
+
+// remove removes the file p, fullpath being its bucket path
+func (fs *filesystem) remove(p, fullpath string) error {
+	file, err := fs.fetch(p)
+	if err != nil {
+		return err
+	}
+
+	if file.Isdir {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.EISDIR}
+	}
+
+	if err := fs.backend.Delete(file.OssPath(fullpath)); err != nil {
+		return err
+	}
+
+	fs.forget(p)
+	fs.keepParent(fullpath)
+	return nil
+}
+
+// keepParent makes sure the parent of fullpath outlives its last child, an
+// implicit directory only exists as long as some key starts with its prefix
+// so it gets a marker object
+func (fs *filesystem) keepParent(fullpath string) {
+	parent := path.Dir(fullpath)
+	if parent == fs.home || parent == "/" {
+		return
+	}
+
+	key := strings.TrimLeft(parent, "/") + "/"
+	if _, err := fs.backend.Head(key); err != os.ErrNotExist {
+		return
+	}
+
+	if err := fs.backend.Put(key, []byte{}); err != nil {
+		logger.Warnf("unable to create the marker of %s: %s", parent, err)
+	}
+}
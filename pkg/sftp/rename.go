@@ -0,0 +1,235 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/storage"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// number of objects copied at the same time by a directory rename
+	renameWorkers = 8
+	// number of attempts made for every copy and delete before giving up
+	renameAttempts = 3
+)
+
+// rename moves the file or directory src to dst, both are request paths
+func (fs *filesystem) rename(src, dst string) error {
+	srcpath, err := fs.resolve(src)
+	if err != nil {
+		return err
+	}
+
+	dstpath, err := fs.resolve(dst)
+	if err != nil {
+		return err
+	}
+
+	if srcpath == fs.home {
+		return sftp.ErrSshFxPermissionDenied
+	}
+
+	if err := fs.refresh(filepath.Dir(src)); err != nil {
+		return err
+	}
+
+	file, err := fs.fetch(src)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Dir(dst) != filepath.Dir(src) {
+		if err := fs.refresh(filepath.Dir(dst)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fs.fetch(dst); err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: fmt.Errorf("dest file exists")}
+	}
+
+	if file.Isdir {
+		if dstpath == srcpath || strings.HasPrefix(dstpath, srcpath+"/") {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: fmt.Errorf("can not move a directory into itself")}
+		}
+
+		srcPrefix, dstPrefix := file.OssPath(srcpath), file.OssPath(dstpath)
+		objects, err := listTree(fs.backend, srcPrefix)
+		if err != nil {
+			return err
+		}
+
+		// the rules may protect some of the children, or their new paths
+		srcKeys := make([]string, len(objects))
+		dstKeys := make([]string, len(objects))
+		for index, object := range objects {
+			srcKeys[index] = object.Key
+			dstKeys[index] = dstPrefix + strings.TrimPrefix(object.Key, srcPrefix)
+		}
+
+		if err := fs.authorizeTree(auth.OpDelete, srcKeys); err != nil {
+			return err
+		}
+
+		if err := fs.authorizeTree(auth.OpWrite, dstKeys); err != nil {
+			return err
+		}
+
+		if err := renameTree(fs.backend, objects, srcPrefix, dstPrefix); err != nil {
+			return err
+		}
+
+		fs.forgetTree(src)
+	} else {
+		object := storage.Object{Key: file.OssPath(srcpath), Size: file.Fsize}
+		if err := copyObject(fs.backend, object, file.OssPath(dstpath)); err != nil {
+			return err
+		}
+
+		if err := fs.backend.Delete(object.Key); err != nil {
+			return err
+		}
+
+		fs.forget(src)
+	}
+
+	fs.keepParent(srcpath)
+
+	renamed := *file
+	renamed.Fname = filepath.Base(dst)
+	fs.store(dst, &renamed)
+	return nil
+}
+
+// renameTree moves the objects below the src prefix to the dst prefix.
+// The objects are all copied before any of them is deleted, when a copy
+// keeps failing the copies already made are removed again and src is left
+// untouched.
+func renameTree(backend storage.Backend, objects []storage.Object, src, dst string) error {
+	if len(objects) == 0 {
+		return os.ErrNotExist
+	}
+
+	copied, err := copyTree(backend, objects, src, dst)
+	if err != nil {
+		if len(copied) > 0 {
+			if rerr := retry(func() error { return backend.Delete(copied...) }); rerr != nil {
+				logger.Errorf("unable to roll back the rename of %s to %s: %s", src, dst, rerr)
+			}
+		}
+
+		return err
+	}
+
+	keys := make([]string, len(objects))
+	for index, object := range objects {
+		keys[index] = object.Key
+	}
+
+	if err := retry(func() error { return backend.Delete(keys...) }); err != nil {
+		return fmt.Errorf("%s was copied to %s but could not be removed: %s", src, dst, err)
+	}
+
+	return nil
+}
+
+// listTree returns every object below prefix, the prefix itself included
+func listTree(backend storage.Backend, prefix string) ([]storage.Object, error) {
+	objects := make([]storage.Object, 0)
+
+	marker := ""
+	for {
+		resp, err := backend.List(prefix, "", marker, listPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get list of oss files: %s", err)
+		}
+
+		objects = append(objects, resp.Objects...)
+		if !resp.IsTruncated || resp.NextMarker == "" {
+			return objects, nil
+		}
+
+		marker = resp.NextMarker
+	}
+}
+
+// copyTree copies objects from below src to below dst with a pool of
+// workers and returns the keys it created, no new copy is started once
+// one of them failed
+func copyTree(backend storage.Backend, objects []storage.Object, src, dst string) ([]string, error) {
+	var (
+		copied   = make([]string, 0, len(objects))
+		firstErr error
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	jobs := make(chan storage.Object)
+	for i := 0; i < renameWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for object := range jobs {
+				key := dst + strings.TrimPrefix(object.Key, src)
+				err := retry(func() error { return copyObject(backend, object, key) })
+
+				lock.Lock()
+				if err == nil {
+					copied = append(copied, key)
+				} else if firstErr == nil {
+					firstErr = fmt.Errorf("unable to copy %s to %s: %s", object.Key, key, err)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, object := range objects {
+		lock.Lock()
+		failed := firstErr != nil
+		lock.Unlock()
+
+		if failed {
+			break
+		}
+
+		jobs <- object
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return copied, firstErr
+}
+
+func copyObject(backend storage.Backend, object storage.Object, dstKey string) error {
+	if object.Size >= storage.LargeCopySize {
+		return backend.CopyLarge(object.Key, dstKey, nil)
+	}
+
+	return backend.Copy("", object.Key, dstKey)
+}
+
+// retry calls fn until it succeeds, the key turns out to be missing or
+// renameAttempts attempts were made
+func retry(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || err == os.ErrNotExist || attempt == renameAttempts {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+	}
+}
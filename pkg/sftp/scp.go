@@ -0,0 +1,675 @@
+package sftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// size of the chunks files are copied in
+const scpBufferSize = 32 << 10
+
+// scp runs the "scp -t" sink or the "scp -f" source of an exec request on
+// top of the handlers of the sftp server, so that the same checks apply
+type scp struct {
+	handlers sftp.Handlers
+	user     *auth.User
+	channel  io.ReadWriter
+	r        *bufio.Reader
+
+	sink      bool // -t, the client sends files
+	recursive bool // -r
+	preserve  bool // -p, keep the modification times and modes
+	targetDir bool // -d, the target must be a directory
+	paths     []string
+}
+
+// scpWarning is an error reported to the peer which does not end the transfer
+type scpWarning struct {
+	msg string
+}
+
+func (w *scpWarning) Error() string { return w.msg }
+
+func isWarning(err error) bool {
+	_, ok := err.(*scpWarning)
+	return ok
+}
+
+// parseSCP parses the command of an exec request, it fails on anything
+// else than an scp sink or source
+func parseSCP(command string) (*scp, error) {
+	words, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(words) == 0 || path.Base(words[0]) != "scp" {
+		return nil, fmt.Errorf("unsupported command %q", command)
+	}
+
+	s := &scp{}
+	source := false
+
+	args := words[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag := args[0]
+		args = args[1:]
+
+		if flag == "--" {
+			break
+		}
+
+		for _, c := range flag[1:] {
+			switch c {
+			case 't':
+				s.sink = true
+			case 'f':
+				source = true
+			case 'r':
+				s.recursive = true
+			case 'p':
+				s.preserve = true
+			case 'd':
+				s.targetDir = true
+			case 'v', 'q':
+			default:
+				return nil, fmt.Errorf("unsupported scp option -%c", c)
+			}
+		}
+	}
+
+	if s.sink == source {
+		return nil, fmt.Errorf("scp needs either -t or -f")
+	}
+
+	if len(args) == 0 || (s.sink && len(args) != 1) {
+		return nil, fmt.Errorf("invalid scp arguments %q", command)
+	}
+
+	for _, arg := range args {
+		s.paths = append(s.paths, path.Clean("/"+arg))
+	}
+
+	return s, nil
+}
+
+// splitCommand splits command into words the way a shell does, quotes and
+// backslashes included
+func splitCommand(command string) ([]string, error) {
+	words := make([]string, 0)
+	word := strings.Builder{}
+	inWord := false
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\' && i+1 < len(command):
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(command[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in %q", command)
+			}
+
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// run serves the transfer and returns the exit status of the command
+func (s *scp) run(channel io.ReadWriter, handlers sftp.Handlers, user *auth.User) int {
+	s.channel = channel
+	s.handlers = handlers
+	s.user = user
+	s.r = bufio.NewReader(channel)
+
+	var err error
+	if s.sink {
+		err = s.receive(s.paths[0])
+	} else {
+		err = s.send(s.paths)
+	}
+
+	if err != nil {
+		logger.Warnf("scp of %s failed: %s", user.Name, err)
+		return 1
+	}
+
+	return 0
+}
+
+// receive implements "scp -t target"
+func (s *scp) receive(target string) error {
+	targetIsDir := s.isDir(target)
+	if s.targetDir && !targetIsDir {
+		return s.fatal(fmt.Errorf("%s: not a directory", target))
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	dirs := make([]string, 0)
+	var mtime time.Time
+	failed := false
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fatal(fmt.Errorf("empty scp message"))
+		}
+
+		switch line[0] {
+		case 0x01, 0x02:
+			logger.Warnf("scp client of %s reported: %s", s.user.Name, line[1:])
+			failed = true
+
+			if line[0] == 0x02 {
+				return fmt.Errorf("%s", line[1:])
+			}
+		case 'T':
+			fields := strings.Fields(line[1:])
+			if len(fields) != 4 {
+				return s.fatal(fmt.Errorf("invalid scp times %q", line))
+			}
+
+			seconds, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return s.fatal(fmt.Errorf("invalid scp times %q", line))
+			}
+
+			mtime = time.Unix(seconds, 0)
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return s.fatal(fmt.Errorf("unexpected end of directory"))
+			}
+
+			dirs = dirs[:len(dirs)-1]
+			if err := s.ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseSCPHeader(line)
+			if err != nil {
+				return s.fatal(err)
+			}
+
+			dst := target
+			if len(dirs) > 0 {
+				dst = path.Join(dirs[len(dirs)-1], name)
+			} else if targetIsDir {
+				dst = path.Join(target, name)
+			}
+
+			if line[0] == 'D' {
+				err = s.mkdir(dst, mode, mtime)
+				if err == nil {
+					dirs = append(dirs, dst)
+				}
+			} else {
+				err = s.receiveFile(dst, mode, size, mtime)
+			}
+
+			mtime = time.Time{}
+			if isWarning(err) {
+				failed = true
+			}
+
+			if err := s.reply(err); err != nil {
+				return err
+			}
+		default:
+			return s.fatal(fmt.Errorf("invalid scp message %q", line))
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("some files were not received")
+	}
+
+	return nil
+}
+
+// parseSCPHeader parses a "C<mode> <size> <name>" or "D<mode> 0 <name>" message
+func parseSCPHeader(line string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid scp message %q", line)
+	}
+
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid scp mode %q", fields[0])
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid scp size %q", fields[1])
+	}
+
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid scp file name %q", name)
+	}
+
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// mkdir creates the directory dst unless it exists already
+func (s *scp) mkdir(dst string, mode os.FileMode, mtime time.Time) error {
+	info, err := s.stat(dst)
+	if err == nil && !info.IsDir() {
+		return &scpWarning{fmt.Sprintf("%s: not a directory", dst)}
+	}
+
+	if err != nil {
+		if err := s.handlers.FileCmd.Filecmd(sftp.NewRequest("Mkdir", dst)); err != nil {
+			return &scpWarning{fmt.Sprintf("%s: %s", dst, err)}
+		}
+	}
+
+	if s.preserve {
+		if err := s.setstat(dst, mode, mtime); err != nil {
+			logger.Warnf("unable to set the attributes of %s: %s", dst, err)
+		}
+	}
+
+	return nil
+}
+
+// receiveFile stores the size bytes following the header of a file in dst
+func (s *scp) receiveFile(dst string, mode os.FileMode, size int64, mtime time.Time) error {
+	writer, err := s.handlers.FilePut.Filewrite(sftp.NewRequest("Put", dst))
+	if err != nil {
+		return &scpWarning{fmt.Sprintf("%s: %s", dst, err)}
+	}
+
+	if err := s.ack(); err != nil {
+		failFile(writer, err)
+		CloseFile(writer)
+		return err
+	}
+
+	// the data is read to the end whatever happens, the protocol would be
+	// out of sync otherwise
+	var werr error
+	buf := make([]byte, scpBufferSize)
+	for offset := int64(0); offset < size; {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+
+		if _, err := io.ReadFull(s.r, buf[:n]); err != nil {
+			// the client is gone, what was received is incomplete
+			failFile(writer, err)
+			CloseFile(writer)
+			return err
+		}
+
+		if werr == nil {
+			if _, werr = writer.WriteAt(buf[:n], offset); werr != nil {
+				failFile(writer, werr)
+			}
+		}
+
+		offset += n
+	}
+
+	if err := s.readAck(); err != nil {
+		// the client failed to read the file, what was received is dropped
+		failFile(writer, err)
+		CloseFile(writer)
+
+		if isWarning(err) {
+			return &scpWarning{fmt.Sprintf("%s: %s", dst, err)}
+		}
+
+		return err
+	}
+
+	if werr == nil && s.preserve {
+		werr = s.setstat(dst, mode, mtime)
+	}
+
+	if err := CloseFile(writer); werr == nil {
+		werr = err
+	}
+
+	if werr != nil {
+		return &scpWarning{fmt.Sprintf("%s: %s", dst, werr)}
+	}
+
+	return nil
+}
+
+// send implements "scp -f paths..."
+func (s *scp) send(paths []string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, p := range paths {
+		if err := s.sendPath(p); err != nil {
+			if !isWarning(err) {
+				return err
+			}
+
+			failed = true
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("some files were not sent")
+	}
+
+	return nil
+}
+
+// sendPath sends the file or the directory p, the errors which only
+// concern p are reported to the client as warnings
+func (s *scp) sendPath(p string) error {
+	info, err := s.stat(p)
+	if err != nil {
+		return s.warn(fmt.Errorf("%s: %s", p, err))
+	}
+
+	if info.IsDir() {
+		if !s.recursive {
+			return s.warn(fmt.Errorf("%s: not a regular file", p))
+		}
+
+		return s.sendDir(p, info)
+	}
+
+	return s.sendFile(p, info)
+}
+
+func (s *scp) sendDir(p string, info os.FileInfo) error {
+	if err := s.sendTimes(info); err != nil {
+		return err
+	}
+
+	if err := s.sendMessage(fmt.Sprintf("D%04o 0 %s\n", info.Mode().Perm(), path.Base(p))); err != nil {
+		return err
+	}
+
+	var failed error
+
+	entries, err := s.list(p)
+	if err != nil {
+		if failed = s.warn(fmt.Errorf("%s: %s", p, err)); !isWarning(failed) {
+			return failed
+		}
+	}
+	for _, entry := range entries {
+		// symlinks to directories could make the walk endless
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if target, err := s.stat(path.Join(p, entry.Name())); err == nil && target.IsDir() {
+				continue
+			}
+		}
+
+		if err := s.sendPath(path.Join(p, entry.Name())); err != nil {
+			if !isWarning(err) {
+				return err
+			}
+
+			failed = err
+		}
+	}
+
+	if err := s.sendMessage("E\n"); err != nil {
+		return err
+	}
+
+	return failed
+}
+
+func (s *scp) sendFile(p string, info os.FileInfo) error {
+	reader, err := s.handlers.FileGet.Fileread(sftp.NewRequest("Get", p))
+	if err != nil {
+		return s.warn(fmt.Errorf("%s: %s", p, err))
+	}
+	defer CloseFile(reader)
+
+	if err := s.sendTimes(info); err != nil {
+		return err
+	}
+
+	if err := s.sendMessage(fmt.Sprintf("C%04o %d %s\n", info.Mode().Perm(), info.Size(), path.Base(p))); err != nil {
+		return err
+	}
+
+	// once the header is sent the client expects size bytes, a failed read
+	// is padded with zeroes and reported afterwards
+	var rerr error
+	buf := make([]byte, scpBufferSize)
+	for offset := int64(0); offset < info.Size(); {
+		n := int64(len(buf))
+		if info.Size()-offset < n {
+			n = info.Size() - offset
+		}
+
+		chunk := buf[:n]
+		if rerr == nil {
+			var read int
+			read, rerr = reader.ReadAt(chunk, offset)
+			if rerr == io.EOF && int64(read) == n {
+				rerr = nil
+			}
+		}
+
+		if rerr != nil {
+			for index := range chunk {
+				chunk[index] = 0
+			}
+		}
+
+		if _, err := s.channel.Write(chunk); err != nil {
+			return err
+		}
+
+		offset += n
+	}
+
+	if rerr != nil {
+		// the warning replaces the final acknowledgement, the client answers it
+		if err := s.warn(fmt.Errorf("%s: %s", p, rerr)); !isWarning(err) {
+			return err
+		}
+
+		if err := s.readAck(); err != nil && !isWarning(err) {
+			return err
+		}
+
+		return &scpWarning{rerr.Error()}
+	}
+
+	return s.sendMessage("\x00")
+}
+
+// sendTimes sends the modification time of info when times are preserved
+func (s *scp) sendTimes(info os.FileInfo) error {
+	if !s.preserve {
+		return nil
+	}
+
+	mtime := info.ModTime().Unix()
+	return s.sendMessage(fmt.Sprintf("T%d 0 %d 0\n", mtime, mtime))
+}
+
+// sendMessage sends msg and waits for the client to acknowledge it
+func (s *scp) sendMessage(msg string) error {
+	if _, err := io.WriteString(s.channel, msg); err != nil {
+		return err
+	}
+
+	return s.readAck()
+}
+
+// readAck reads the answer of the peer to the last message
+func (s *scp) readAck() error {
+	code, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if code == 0 {
+		return nil
+	}
+
+	msg, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	msg = strings.TrimSuffix(msg, "\n")
+	if code == 0x01 {
+		return &scpWarning{msg}
+	}
+
+	return fmt.Errorf("%s", msg)
+}
+
+func (s *scp) ack() error {
+	_, err := s.channel.Write([]byte{0})
+	return err
+}
+
+// reply acknowledges the last message, or reports err to the peer. Only
+// the errors of the connection are returned.
+func (s *scp) reply(err error) error {
+	switch err.(type) {
+	case nil:
+		return s.ack()
+	case *scpWarning:
+		s.warn(err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// warn reports err to the peer, the transfer goes on
+func (s *scp) warn(err error) error {
+	logger.Warnf("scp of %s: %s", s.user.Name, err)
+
+	if _, werr := fmt.Fprintf(s.channel, "\x01scp: %s\n", err); werr != nil {
+		return werr
+	}
+
+	return &scpWarning{err.Error()}
+}
+
+// fatal reports err to the peer and returns it, the transfer ends
+func (s *scp) fatal(err error) error {
+	fmt.Fprintf(s.channel, "\x02scp: %s\n", err)
+	return err
+}
+
+func (s *scp) stat(p string) (os.FileInfo, error) {
+	return Stat(s.handlers, p)
+}
+
+// isDir tells whether p is a directory. A user who may write to p without
+// listing it, like the user of a drop box, learns it through the write side.
+func (s *scp) isDir(p string) bool {
+	info, err := s.stat(p)
+	if err == nil {
+		return info.IsDir()
+	}
+
+	checker, ok := s.handlers.FileCmd.(interface{ isDir(p string) (bool, error) })
+	if err != sftp.ErrSshFxPermissionDenied || !ok {
+		return false
+	}
+
+	dir, _ := checker.isDir(p)
+	return dir
+}
+
+func (s *scp) list(p string) ([]os.FileInfo, error) {
+	lister, err := s.handlers.FileList.Filelist(sftp.NewRequest("List", p))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.FileInfo, 0)
+	page := make([]os.FileInfo, 128)
+	for {
+		n, err := lister.ListAt(page, int64(len(entries)))
+		entries = append(entries, page[:n]...)
+
+		if err == io.EOF {
+			return entries, nil
+		}
+
+		if err != nil {
+			return entries, err
+		}
+	}
+}
+
+func (s *scp) setstat(p string, mode os.FileMode, mtime time.Time) error {
+	attrs := &fileAttrs{flags: attrPermissions, mode: mode}
+	if !mtime.IsZero() {
+		attrs.flags |= attrACModTime
+		attrs.mtime = mtime
+	}
+
+	r := sftp.NewRequest("Setstat", p)
+	r.Flags = attrs.flags
+	r.Attrs = attrs.marshal()
+
+	return s.handlers.FileCmd.Filecmd(r)
+}
+
+// failFile makes the upload of writer fail, its data does not get stored
+func failFile(writer interface{}, err error) {
+	if f, ok := writer.(interface{ fail(error) }); ok {
+		f.fail(err)
+	}
+}
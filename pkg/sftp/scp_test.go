@@ -0,0 +1,237 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{"scp -t /dir", []string{"scp", "-t", "/dir"}, false},
+		{"  scp\t-f  a  b ", []string{"scp", "-f", "a", "b"}, false},
+		{`scp -t "/my dir"`, []string{"scp", "-t", "/my dir"}, false},
+		{`scp -t '/it"s'`, []string{"scp", "-t", `/it"s`}, false},
+		{`scp -t /my\ dir`, []string{"scp", "-t", "/my dir"}, false},
+		{`scp -t a""b`, []string{"scp", "-t", "ab"}, false},
+		{`scp -t ""`, []string{"scp", "-t", ""}, false},
+		{`scp -t "/dir`, nil, true},
+		{"", []string{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := splitCommand(test.command)
+		if (err != nil) != test.wantErr {
+			t.Errorf("splitCommand(%q) error = %v, want an error: %t", test.command, err, test.wantErr)
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
+
+func TestParseSCP(t *testing.T) {
+	tests := []struct {
+		command string
+		want    *scp
+		wantErr bool
+	}{
+		{"scp -t /dir", &scp{sink: true, paths: []string{"/dir"}}, false},
+		{"/usr/bin/scp -r -p -d -t -- dir/../file", &scp{sink: true, recursive: true, preserve: true, targetDir: true, paths: []string{"/file"}}, false},
+		{"scp -vf a /b", &scp{paths: []string{"/a", "/b"}}, false},
+		{"scp -f ../../etc/passwd", &scp{paths: []string{"/etc/passwd"}}, false},
+		{"scp -t a b", nil, true},
+		{"scp -t", nil, true},
+		{"scp -t -f a", nil, true},
+		{"scp a", nil, true},
+		{"scp -t -S ssh a", nil, true},
+		{"rm -rf /", nil, true},
+		{"", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseSCP(test.command)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseSCP(%q) error = %v, want an error: %t", test.command, err, test.wantErr)
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSCP(%q) = %+v, want %+v", test.command, got, test.want)
+		}
+	}
+}
+
+func TestParseSCPHeader(t *testing.T) {
+	tests := []struct {
+		line    string
+		mode    uint32
+		size    int64
+		name    string
+		wantErr bool
+	}{
+		{"C0644 5 file", 0644, 5, "file", false},
+		{"C0755 0 my file", 0755, 0, "my file", false},
+		{"D4755 0 dir", 0755, 0, "dir", false},
+		{"C0644 5", 0, 0, "", true},
+		{"C0999 5 file", 0, 0, "", true},
+		{"C0644 -1 file", 0, 0, "", true},
+		{"C0644 5 ..", 0, 0, "", true},
+		{"C0644 5 a/b", 0, 0, "", true},
+	}
+
+	for _, test := range tests {
+		mode, size, name, err := parseSCPHeader(test.line)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseSCPHeader(%q) error = %v, want an error: %t", test.line, err, test.wantErr)
+			continue
+		}
+
+		if err == nil && (uint32(mode) != test.mode || size != test.size || name != test.name) {
+			t.Errorf("parseSCPHeader(%q) = %o %d %q, want %o %d %q", test.line, mode, size, name, test.mode, test.size, test.name)
+		}
+	}
+}
+
+// runSCP runs command against backend with input as what the client sends,
+// it returns the exit status and what the server sent
+func runSCP(t *testing.T, backend storage.Backend, command, input string) (int, string) {
+	s, err := parseSCP(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := &bytes.Buffer{}
+	channel := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(input), output}
+
+	status := s.run(channel, newGuardedHandlers(newFileSystem(backend, nil)), &auth.User{Name: "alice"})
+	return status, output.String()
+}
+
+func TestSCPReceive(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		input   string
+		status  int
+		want    map[string]string
+	}{
+		{"file", "scp -t /", "C0644 5 a.txt\nhello\x00", 0, map[string]string{"a.txt": "hello"}},
+		{"renamed file", "scp -t /b.txt", "C0644 5 a.txt\nhello\x00", 0, map[string]string{"b.txt": "hello"}},
+		{"empty file", "scp -t /", "C0644 0 a.txt\n\x00", 0, map[string]string{"a.txt": ""}},
+		{"directory", "scp -r -t /", "D0755 0 d\nC0644 2 b\nhi\x00E\n", 0, map[string]string{"d/": "", "d/b": "hi"}},
+		{"times", "scp -p -t /", "T1500000000 0 1500000000 0\nC0600 2 b\nhi\x00", 0, map[string]string{"b": "hi"}},
+		{"client error", "scp -t /", "C0644 5 a.txt\nhello\x02read failed\n", 1, map[string]string{}},
+		{"client gone", "scp -t /", "C0644 5 a.txt\nhel", 1, map[string]string{}},
+		{"invalid name", "scp -t /", "C0644 5 ../a.txt\nhello\x00", 1, map[string]string{}},
+		{"end outside a directory", "scp -r -t /", "E\n", 1, map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := storage.NewMemoryBackend()
+
+			status, _ := runSCP(t, backend, test.command, test.input)
+			if status != test.status {
+				t.Errorf("exit status = %d, want %d", status, test.status)
+			}
+
+			result, err := backend.List("", "", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for _, object := range result.Objects {
+				data, _ := backend.Get(object.Key)
+				got[object.Key] = string(data)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("stored %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSCPSend(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	backend.Put("dir/", nil)
+	backend.Put("dir/a.txt", []byte("hello"))
+
+	tests := []struct {
+		name    string
+		command string
+		acks    int
+		status  int
+		want    []string
+	}{
+		{"file", "scp -f /dir/a.txt", 3, 0, []string{"C0644 5 a.txt\n", "hello\x00"}},
+		{"directory", "scp -r -f /dir", 5, 0, []string{"D0755 0 dir\n", "C0644 5 a.txt\n", "hello\x00", "E\n"}},
+		{"directory without -r", "scp -f /dir", 1, 1, []string{"\x01scp: /dir: not a regular file\n"}},
+		{"missing file", "scp -f /missing", 1, 1, []string{"\x01scp: /missing: "}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, output := runSCP(t, backend, test.command, strings.Repeat("\x00", test.acks))
+			if status != test.status {
+				t.Errorf("exit status = %d, want %d", status, test.status)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("output %q does not contain %q", output, want)
+				}
+			}
+		})
+	}
+}
+
+// listDenied refuses every listing and stat like the ACL of a drop box
+type listDenied struct{}
+
+func (listDenied) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	return nil, sftp.ErrSshFxPermissionDenied
+}
+
+func TestSCPReceiveWriteOnly(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	backend.Put("dropbox/", nil)
+
+	s, err := parseSCP("scp -d -t /dropbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := newGuardedHandlers(newFileSystem(backend, nil))
+	handlers.FileList = listDenied{}
+
+	channel := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("C0644 5 a.txt\nhello\x00"), &bytes.Buffer{}}
+
+	if status := s.run(channel, handlers, &auth.User{Name: "alice"}); status != 0 {
+		t.Errorf("exit status = %d, want 0", status)
+	}
+
+	if data, err := backend.Get("dropbox/a.txt"); string(data) != "hello" {
+		t.Errorf("dropbox/a.txt holds %q (%v), want %q", data, err, "hello")
+	}
+}
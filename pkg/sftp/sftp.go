@@ -1,20 +1,94 @@
 package sftp
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
-
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/sftp"
-	"github.com/srelab/common/color"
+	"github.com/srelab/ossproxy/pkg/auth"
 	"github.com/srelab/ossproxy/pkg/g"
 	"github.com/srelab/ossproxy/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
 
-func handleChannels(chans <-chan ssh.NewChannel) {
+var errDisconnected = errors.New("the client disconnected before closing the file")
+
+// handleConn performs the handshake of an incoming connection and serves
+// it, whatever happens to it only ends that connection
+func handleConn(nConn net.Conn, config *ssh.ServerConfig, limiter *connLimiter) {
+	defer nConn.Close()
+	defer recovered(fmt.Sprintf("connection from %s", nConn.RemoteAddr()))
+
+	server.addConn(nConn)
+	defer server.removeConn(nConn)
+
+	if !limiter.open() {
+		logger.Warnf("refusing connection from %s, %d connections are open", nConn.RemoteAddr(), limiter.max)
+		return
+	}
+	defer limiter.close()
+
+	// the deadline only bounds the handshake, the idle timeout takes over
+	if timeout := g.Config().Sftp.HandshakeTimeout; timeout > 0 {
+		nConn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// Before use, a handshake must be performed on the incoming net.Conn.
+	sconn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+	if err != nil {
+		logger.Errorf("failed to handshake with %s: %s", nConn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+
+	nConn.SetDeadline(time.Time{})
+
+	logger.Info("user login detected:", sconn.User())
+	logger.Info("SSH server established")
+
+	user, ok := auth.Users.Lookup(sconn.Permissions.Extensions["user"])
+	if !ok {
+		logger.Errorf("user %s vanished after login", sconn.User())
+		return
+	}
+
+	if !limiter.login(user.Name) {
+		logger.Warnf("refusing connection of %s from %s, %d connections are open", user.Name, nConn.RemoteAddr(), limiter.perUser)
+		return
+	}
+	defer limiter.logout(user.Name)
+
+	a := &activity{}
+	a.touch()
+
+	if timeout := g.Config().Sftp.IdleTimeout; timeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		go closeIdle(sconn, a, timeout, done)
+	}
+
+	// The incoming Request channel must be serviced.
+	go ssh.DiscardRequests(reqs)
+
+	// Service the incoming Channel channel.
+	handleChannels(chans, user, a)
+}
+
+func handleChannels(chans <-chan ssh.NewChannel, user *auth.User, a *activity) {
+	// the channels of a connection share the filesystem of its user
+	root := NewOssHandler(user)
+
+	// a slot is taken for every open session when the channels are limited
+	var slots chan struct{}
+	if max := g.Config().Sftp.MaxChannels; max > 0 {
+		slots = make(chan struct{}, max)
+	}
+
 	for newChannel := range chans {
 		// Channels have a type, depending on the application level
 		// protocol intended. In the case of an SFTP session, this is "subsystem"
@@ -28,45 +102,157 @@ func handleChannels(chans <-chan ssh.NewChannel) {
 			continue
 		}
 
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				newChannel.Reject(ssh.ResourceShortage, "too many channels")
+				logger.Warnf("refusing channel of %s, %d channels are open", user.Name, cap(slots))
+
+				continue
+			}
+		}
+
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			logger.Fatal("could not accept channel.", err)
+			logger.Errorf("could not accept channel of %s: %s", user.Name, err)
+			release(slots)
+
+			continue
 		}
 
 		// accept
 		logger.Info("Channel accepted")
 
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "subsystem" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				logger.Info("Request: %v", req.Type)
-
-				ok := false
-				switch req.Type {
-				case "subsystem":
-					logger.Infof("Subsystem: %s", req.Payload[4:])
-
-					if string(req.Payload[4:]) == "sftp" {
-						ok = true
-					}
-				}
-
-				logger.Infof("channel accepted: %v", ok)
-				req.Reply(ok, nil)
+		go func() {
+			defer release(slots)
+			handleSession(&activeChannel{Channel: channel, activity: a}, requests, root, user)
+		}()
+	}
+}
+
+// release frees a slot of slots, if channels are limited
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// handleSession serves a session channel, a failure only ends that session
+func handleSession(channel ssh.Channel, requests <-chan *ssh.Request, root sftp.Handlers, user *auth.User) {
+	defer channel.Close()
+	defer recovered(fmt.Sprintf("session of %s", user.Name))
+
+	// Sessions have out-of-band requests such as "shell",
+	// "pty-req" and "env".  Here we handle only the
+	// "subsystem" request of sftp and the "exec" request of scp,
+	// the session runs the first one it gets.
+	for req := range requests {
+		logger.Infof("Request: %v", req.Type)
+
+		payload := struct{ Value string }{}
+		switch req.Type {
+		case "subsystem":
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Value != "sftp" {
+				break
+			}
+
+			logger.Infof("Subsystem: %s", payload.Value)
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			serveSFTP(channel, root, user)
+			return
+		case "exec":
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				break
+			}
+
+			command, err := parseSCP(payload.Value)
+			if err != nil {
+				logger.Warnf("exec of %s refused: %s", user.Name, err)
+				break
 			}
-		}(requests)
-
-		root := NewOssHandler()
-		server := sftp.NewRequestServer(channel, root)
-		if err := server.Serve(); err == io.EOF {
-			server.Close()
-			logger.Infof("sftp client exited session.")
-		} else if err != nil {
-			logger.Fatal("sftp server completed with error:", err)
+
+			logger.Infof("Exec: %s", payload.Value)
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			status := struct{ Status uint32 }{uint32(command.run(channel, root, user))}
+			channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+			return
 		}
+
+		logger.Infof("channel accepted: %v", false)
+		req.Reply(false, nil)
+	}
+}
+
+func serveSFTP(channel ssh.Channel, root sftp.Handlers, user *auth.User) {
+	session := &sftpSession{ReadWriteCloser: channel}
+
+	handlers := root
+	handlers.FilePut = &sessionWriters{FileWriter: root.FilePut, session: session}
+
+	rs := sftp.NewRequestServer(session, handlers)
+	if err := rs.Serve(); err == io.EOF {
+		logger.Infof("sftp client exited session.")
+	} else if err != nil {
+		logger.Errorf("sftp session of %s completed with error: %s", user.Name, err)
+	}
+
+	rs.Close()
+}
+
+// sftpSession is the channel of an sftp session, it records when the client
+// is gone. The request server closes the handles still open at that point.
+type sftpSession struct {
+	io.ReadWriteCloser
+	ended int32
+}
+
+func (s *sftpSession) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	if err != nil {
+		atomic.StoreInt32(&s.ended, 1)
+	}
+
+	return n, err
+}
+
+func (s *sftpSession) isEnded() bool {
+	return atomic.LoadInt32(&s.ended) == 1
+}
+
+// sessionWriters hands out the writers of a session, an upload is only
+// stored when the client closed its handle with SSH_FXP_CLOSE
+type sessionWriters struct {
+	sftp.FileWriter
+	session *sftpSession
+}
+
+func (h *sessionWriters) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	writer, err := h.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
 	}
+
+	return &sessionWriter{WriterAt: writer, session: h.session}, nil
+}
+
+type sessionWriter struct {
+	io.WriterAt
+	session *sftpSession
+}
+
+func (w *sessionWriter) Close() error {
+	// once the session ended the handles are closed by the request server,
+	// not by the client, whatever was written so far is incomplete
+	if w.session.isEnded() {
+		failFile(w.WriterAt, errDisconnected)
+	}
+
+	return CloseFile(w.WriterAt)
 }
 
 func Start() {
@@ -74,29 +260,39 @@ func Start() {
 	// certificate details and handles authentication of ServerConns.
 	config := &ssh.ServerConfig{
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in
-			// a production setting.
 			logger.Infof("User Login: %s", c.User())
-			if c.User() == "testuser" && string(pass) == "tiger" {
-				return nil, nil
+
+			user, err := auth.Users.Authenticate(c.User(), pass)
+			if err != nil {
+				logger.Warnf("password rejected for %q from %s: %s", c.User(), c.RemoteAddr(), err)
+				return nil, fmt.Errorf("password rejected for %q", c.User())
 			}
 
-			return nil, fmt.Errorf("password rejected for %q", c.User())
+			return &ssh.Permissions{Extensions: map[string]string{"user": user.Name}}, nil
 		},
-	}
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			logger.Infof("User Login: %s (%s)", c.User(), ssh.FingerprintSHA256(key))
 
-	privateBytes, err := ioutil.ReadFile(g.Config().Sftp.Keypath)
-	if err != nil {
-		logger.Fatal("Failed to load private key", err)
+			user, err := auth.Users.AuthenticateKey(c.User(), key, c.RemoteAddr())
+			if err != nil {
+				logger.Warnf("public key rejected for %q from %s: %s", c.User(), c.RemoteAddr(), err)
+				return nil, fmt.Errorf("public key rejected for %q", c.User())
+			}
+
+			return &ssh.Permissions{Extensions: map[string]string{"user": user.Name}}, nil
+		},
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	signers, err := loadHostKeys(g.Config().Sftp.Keydir, g.Config().Sftp.Keypath)
 	if err != nil {
-		logger.Fatal("Failed to parse private key", err)
+		logger.Fatal("Failed to load host keys", err)
 	}
 
-	// AddHostKey adds a private key as a host key
-	config.AddHostKey(private)
+	// AddHostKey adds a private key as a host key, clients can pin the fingerprints
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+		logger.Infof("host key %s %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
 
 	// Once a ServerConfig has been configured, connections can be accepted.
 	address := fmt.Sprintf("%s:%s", g.Config().Sftp.Host, g.Config().Sftp.Port)
@@ -105,30 +301,10 @@ func Start() {
 		logger.Fatal("failed to listen for connection", err)
 	}
 
-	color.Printf("⇨ sftp server started on %s\n", color.Green(listener.Addr()))
+	cfg := g.Config().Sftp
+	limiter := newConnLimiter(cfg.MaxConns, cfg.MaxUserConns)
 
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			logger.Fatal("failed to accept incoming connection", err)
-		}
-
-		// Before use, a handshake must be performed on the incoming net.Conn.
-		sconn, chans, reqs, err := ssh.NewServerConn(nConn, config)
-		if err != nil {
-			logger.Error("failed to handshake", err)
-			nConn.Close()
-
-			continue
-		}
-
-		logger.Info("user login detected:", sconn.User())
-		logger.Info("SSH server established")
-
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
-
-		// Service the incoming Channel channel.
-		go handleChannels(chans)
-	}
+	server.Serve("sftp", listener, func(nConn net.Conn) {
+		handleConn(nConn, config, limiter)
+	})
 }
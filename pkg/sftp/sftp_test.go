@@ -0,0 +1,87 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/srelab/ossproxy/pkg/auth"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+// pipeChannel turns one end of a net.Pipe into the channel of a session
+type pipeChannel struct {
+	net.Conn
+}
+
+func (c pipeChannel) CloseWrite() error { return nil }
+
+func (c pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func (c pipeChannel) Stderr() io.ReadWriter { return c.Conn }
+
+func TestServeSFTPUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		close  bool
+		stored bool
+	}{
+		{"closed by the client", true, true},
+		{"connection dropped", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := storage.NewMemoryBackend()
+			server, client := net.Pipe()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveSFTP(pipeChannel{server}, newGuardedHandlers(newFileSystem(backend, nil)), &auth.User{Name: "alice"})
+			}()
+
+			sftpClient, err := sftp.NewClientPipe(client, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := sftpClient.Create("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := bytes.Repeat([]byte("x"), 1000)
+			if _, err := file.Write(data); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.close {
+				if err := file.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the session closes the handles left open once the client is gone
+			client.Close()
+			<-done
+
+			stored, err := backend.Get("file")
+			if test.stored && !bytes.Equal(stored, data) {
+				t.Errorf("stored %d bytes (%v), want the %d bytes written", len(stored), err, len(data))
+			}
+
+			if !test.stored && err == nil {
+				t.Error("the upload of the dropped connection was stored")
+			}
+
+			if n := tempObjects(t, backend); n != 0 {
+				t.Errorf("%d temporary objects or uploads left behind", n)
+			}
+		})
+	}
+}
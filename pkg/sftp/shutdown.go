@@ -0,0 +1,112 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/lifecycle"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// time the interrupted uploads get to abort once their connection is closed
+const abortGrace = 10 * time.Second
+
+var errShutdown = errors.New("the server is shutting down")
+
+// server keeps track of what Shutdown has to drain
+var server = &serverState{
+	conns:   make(map[net.Conn]bool),
+	writers: make(map[*uploadWriter]bool),
+}
+
+type serverState struct {
+	lifecycle.Listener
+
+	lock      sync.Mutex
+	conns     map[net.Conn]bool
+	transfers int // files open for reading or writing
+	writers   map[*uploadWriter]bool
+}
+
+func (s *serverState) addConn(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conns[conn] = true
+}
+
+func (s *serverState) removeConn(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// open records a transfer, w is only set for uploads
+func (s *serverState) open(w *uploadWriter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.transfers++
+	if w != nil {
+		s.writers[w] = true
+	}
+}
+
+func (s *serverState) close(w *uploadWriter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.transfers--
+	if w != nil {
+		delete(s.writers, w)
+	}
+}
+
+func (s *serverState) pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.transfers
+}
+
+// interrupt fails the uploads still open, so that their multipart uploads
+// are aborted rather than completed, and closes every connection
+func (s *serverState) interrupt() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for w := range s.writers {
+		w.fail(errShutdown)
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown stops accepting connections and lets the open transfers finish
+// until ctx is done, the connections are closed afterwards
+func Shutdown(ctx context.Context) error {
+	server.Stop()
+
+	err := lifecycle.Drain(ctx, server.pending)
+	if err != nil {
+		logger.Warnf("interrupting %d sftp transfers", server.pending())
+	}
+
+	server.interrupt()
+
+	// the request servers close the handles of the closed connections
+	grace, cancel := context.WithTimeout(context.Background(), abortGrace)
+	defer cancel()
+
+	if err := lifecycle.Drain(grace, server.pending); err != nil {
+		logger.Errorf("%d sftp transfers did not close, their uploads are left to the janitor", server.pending())
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+package sftp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/auth"
+)
+
+const (
+	// user metadata key holding the target of a symlink, the content of the
+	// object is the target as well
+	metaSymlink = "symlink"
+	// maximum number of symlinks followed to resolve a path
+	maxSymlinkDepth = 8
+)
+
+// linkInfo is what Readlink answers, the name of the file is the target
+type linkInfo struct {
+	*memFile
+	target string
+}
+
+func (l *linkInfo) Name() string { return l.target }
+
+// symlink creates link pointing to target, both are request paths so the
+// target can not leave the home of the filesystem
+func (fs *filesystem) symlink(target, link string) error {
+	linkpath, err := fs.resolve(link)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.resolve(target); err != nil {
+		return err
+	}
+
+	if err := fs.refresh(filepath.Dir(link)); err != nil {
+		return err
+	}
+
+	if _, err := fs.fetch(link); err == nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: syscall.EEXIST}
+	}
+
+	dir, err := fs.fetch(filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+
+	if !dir.Isdir {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: syscall.ENOTDIR}
+	}
+
+	key := strings.TrimLeft(linkpath, "/")
+	if err := fs.backend.PutWithMeta(key, []byte(target), map[string]string{metaSymlink: target}); err != nil {
+		return err
+	}
+
+	file := newMemFile(filepath.Base(link), false, false, int64(len(target)), time.Now())
+	file.Symlink = target
+	fs.store(link, file)
+	return nil
+}
+
+// follow resolves the symlinks p may point to, every target must be
+// authorized for op. It returns the file found at the end of the chain
+// along with its bucket path.
+func (fs *filesystem) follow(op auth.Op, p, fullpath string, file *memFile) (*memFile, string, error) {
+	for depth := 0; ; depth++ {
+		var err error
+		if file, err = fs.stat(p, fullpath, file); err != nil {
+			return nil, "", err
+		}
+
+		if file.Symlink == "" {
+			return file, fullpath, nil
+		}
+
+		if depth == maxSymlinkDepth {
+			return nil, "", &os.PathError{Op: "open", Path: p, Err: syscall.ELOOP}
+		}
+
+		p = file.Symlink
+		if fullpath, err = fs.resolve(p); err != nil {
+			return nil, "", err
+		}
+
+		if err := fs.authorize(op, fullpath); err != nil {
+			return nil, "", err
+		}
+
+		target, err := fs.fetch(p)
+		if err == os.ErrNotExist {
+			if err := fs.refresh(filepath.Dir(p)); err != nil {
+				return nil, "", err
+			}
+
+			target, err = fs.fetch(p)
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		file = target
+	}
+}
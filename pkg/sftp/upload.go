@@ -0,0 +1,143 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+const (
+	// prefix the uploads are written to until they complete, below the root
+	// of the bucket of their key, it is hidden from the listings
+	uploadPrefix = ".uploading/"
+	// how often the janitor looks for abandoned uploads
+	janitorInterval = time.Hour
+)
+
+// mountRoot returns the prefix of the bucket key is stored in
+func mountRoot(key string) string {
+	if Mounts == nil {
+		return ""
+	}
+
+	return Mounts.Root(key)
+}
+
+// newTempKey returns a unique temporary key in the same bucket as key, its
+// name starts with the time it was created at so that the janitor can tell
+// how old it is
+func newTempKey(key string) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return fmt.Sprintf("%s%s%d-%s", mountRoot(key), uploadPrefix, time.Now().UnixNano(), hex.EncodeToString(id))
+}
+
+// isTempKey reports whether key, or the prefix key, is hidden from the listings
+func isTempKey(key string) bool {
+	return strings.HasPrefix(key, mountRoot(key)+uploadPrefix)
+}
+
+// tempKeyTime returns the time the temporary key was created at
+func tempKeyTime(key string) (time.Time, bool) {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if index := strings.Index(name, "-"); index > 0 {
+		name = name[:index]
+	}
+
+	nano, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, nano), true
+}
+
+// Upload writes the content of r to key, the object only shows up under
+// key once all of it has been uploaded
+func Upload(key string, r io.Reader) error {
+	w := newUploadWriter(Backend, key)
+
+	buf := make([]byte, uploadPartSize)
+	offset := int64(0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := w.WriteAt(buf[:n], offset); werr != nil {
+				w.Close()
+				return werr
+			}
+
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return w.Close()
+		}
+
+		if err != nil {
+			w.err = err
+			w.Close()
+			return err
+		}
+	}
+}
+
+// janitor removes the temporary objects and multipart uploads older
+// than maxAge, these are the leftovers of interrupted transfers
+func janitor(backend storage.Backend, maxAge time.Duration) {
+	for range time.Tick(janitorInterval) {
+		roots := []string{""}
+		if Mounts != nil {
+			roots = Mounts.Roots()
+		}
+
+		for _, root := range roots {
+			sweepUploads(backend, root+uploadPrefix, time.Now().Add(-maxAge))
+		}
+	}
+}
+
+func sweepUploads(backend storage.Backend, prefix string, before time.Time) {
+	objects, err := listTree(backend, prefix)
+	if err != nil {
+		logger.Errorf("unable to list abandoned uploads: %s", err)
+		return
+	}
+
+	keys := make([]string, 0)
+	for _, object := range objects {
+		if created, ok := tempKeyTime(object.Key); ok && created.Before(before) {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	if len(keys) > 0 {
+		if err := backend.Delete(keys...); err != nil {
+			logger.Errorf("unable to remove abandoned uploads: %s", err)
+		} else {
+			logger.Infof("removed %d abandoned uploads", len(keys))
+		}
+	}
+
+	uploads, err := backend.Uploads(prefix)
+	if err != nil {
+		logger.Errorf("unable to list abandoned multipart uploads: %s", err)
+		return
+	}
+
+	for _, upload := range uploads {
+		if created, ok := tempKeyTime(upload.Key); ok && created.Before(before) {
+			if err := upload.Abort(); err != nil {
+				logger.Errorf("unable to abort the upload of %s: %s", upload.Key, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+const (
+	// size of the parts sent to the backend, every part but the last one
+	// has to be at least 100KB
+	uploadPartSize = 8 << 20
+	// maximum amount of out-of-order data kept in memory before the
+	// upload falls back to a local spool file
+	reorderWindow = 16 << 20
+)
+
+// uploadWriter implements io.WriterAt on top of a multipart upload. Data is
+// sent part by part as soon as it is contiguous to a temporary key, which
+// is moved to key once the handle gets closed without error.
+type uploadWriter struct {
+	backend storage.Backend
+	key     string
+	tmpKey  string
+
+	upload  storage.Upload
+	parts   int
+	flushed int64  // number of bytes already sent to the backend
+	buf     []byte // contiguous data following flushed
+
+	pending     map[int64][]byte // out-of-order writes waiting for the gap to fill
+	pendingSize int64
+	spool       *os.File // once set every write goes there, relative to flushed
+
+	meta    map[string]string // attributes set while the upload was in progress
+	onClose func()
+
+	err  error
+	lock sync.Mutex
+}
+
+func newUploadWriter(backend storage.Backend, key string) *uploadWriter {
+	return &uploadWriter{
+		backend: backend,
+		key:     key,
+		tmpKey:  newTempKey(key),
+		pending: make(map[int64][]byte),
+	}
+}
+
+func (w *uploadWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if off < w.flushed {
+		w.err = fmt.Errorf("rewriting already uploaded data at offset %d is not supported", off)
+		return 0, w.err
+	}
+
+	if w.spool != nil {
+		if _, err := w.spool.WriteAt(p, off-w.flushed); err != nil {
+			w.err = err
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	if off > w.flushed+int64(len(w.buf)) {
+		w.pending[off] = append([]byte(nil), p...)
+		w.pendingSize += int64(len(p))
+
+		if w.pendingSize > reorderWindow {
+			if err := w.startSpool(); err != nil {
+				w.err = err
+				return 0, err
+			}
+		}
+
+		return len(p), nil
+	}
+
+	w.write(p, off)
+	w.drain()
+
+	if err := w.flush(false); err != nil {
+		w.err = err
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *uploadWriter) Close() error {
+	if w.onClose != nil {
+		defer w.onClose()
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.spool != nil {
+		defer os.Remove(w.spool.Name())
+		defer w.spool.Close()
+	}
+
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = fmt.Errorf("upload of %s is missing data at offset %d", w.key, w.flushed+int64(len(w.buf)))
+	}
+
+	if w.err != nil {
+		if w.upload != nil {
+			w.upload.Abort()
+		}
+
+		return w.err
+	}
+
+	size, err := w.finish()
+	if err == nil {
+		err = w.promote(size)
+	}
+
+	if err != nil {
+		w.err = err
+		w.backend.Delete(w.tmpKey)
+	}
+
+	return w.err
+}
+
+// finish sends the remaining data, completes the upload and returns the
+// size of the temporary object
+func (w *uploadWriter) finish() (int64, error) {
+	if w.spool != nil {
+		info, err := w.spool.Stat()
+		if err != nil {
+			return 0, w.abort(err)
+		}
+
+		if w.upload == nil && info.Size() <= uploadPartSize {
+			data, err := ioutil.ReadAll(io.NewSectionReader(w.spool, 0, info.Size()))
+			if err != nil {
+				return 0, err
+			}
+
+			return info.Size(), w.backend.Put(w.tmpKey, data)
+		}
+
+		for offset := int64(0); offset < info.Size(); offset += uploadPartSize {
+			if err := w.putPart(io.NewSectionReader(w.spool, offset, uploadPartSize)); err != nil {
+				return 0, w.abort(err)
+			}
+		}
+
+		return info.Size(), w.abort(w.upload.Complete())
+	}
+
+	// small files are sent with a single PUT
+	if w.upload == nil {
+		return int64(len(w.buf)), w.backend.Put(w.tmpKey, w.buf)
+	}
+
+	size := w.flushed + int64(len(w.buf))
+	if err := w.flush(true); err != nil {
+		return 0, w.abort(err)
+	}
+
+	return size, w.abort(w.upload.Complete())
+}
+
+// fail makes the upload fail with err, Close aborts it rather than storing it
+func (w *uploadWriter) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// abort aborts the multipart upload when err is set and returns err
+func (w *uploadWriter) abort(err error) error {
+	if err != nil && w.upload != nil {
+		w.upload.Abort()
+	}
+
+	return err
+}
+
+// promote moves the uploaded temporary object to its final key along with
+// the attributes set meanwhile, a temporary object left behind is removed
+// by the janitor later on
+func (w *uploadWriter) promote(size int64) error {
+	var err error
+	if len(w.meta) > 0 {
+		err = w.backend.CopyLarge(w.tmpKey, w.key, w.meta)
+	} else {
+		err = copyObject(w.backend, storage.Object{Key: w.tmpKey, Size: size}, w.key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the temporary object is the only copy of the data until the final
+	// key is known to hold all of it
+	object, err := w.backend.Head(w.key)
+	if err != nil {
+		return fmt.Errorf("unable to check the copy of %s: %s", w.key, err)
+	}
+
+	if object.Size != size {
+		return fmt.Errorf("%s holds %d bytes after the copy, want %d", w.key, object.Size, size)
+	}
+
+	if err := w.backend.Delete(w.tmpKey); err != nil {
+		logger.Warnf("unable to remove %s after uploading %s: %s", w.tmpKey, w.key, err)
+	}
+
+	return nil
+}
+
+// setMeta sets metadata the object gets once the upload completes
+func (w *uploadWriter) setMeta(name, value string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.meta == nil {
+		w.meta = make(map[string]string)
+	}
+
+	w.meta[name] = value
+}
+
+// write copies p into buf, off must not be past the end of buf
+func (w *uploadWriter) write(p []byte, off int64) {
+	pos := off - w.flushed
+	if end := pos + int64(len(p)); end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+
+	copy(w.buf[pos:], p)
+}
+
+// drain moves the pending writes which became contiguous into buf
+func (w *uploadWriter) drain() {
+	for drained := true; drained; {
+		drained = false
+
+		for off, p := range w.pending {
+			if off > w.flushed+int64(len(w.buf)) {
+				continue
+			}
+
+			w.write(p, off)
+			w.pendingSize -= int64(len(p))
+			delete(w.pending, off)
+			drained = true
+		}
+	}
+}
+
+// flush sends every full part of buf, and the remainder too when final is set
+func (w *uploadWriter) flush(final bool) error {
+	for len(w.buf) >= uploadPartSize || (final && len(w.buf) > 0) {
+		n := len(w.buf)
+		if n > uploadPartSize {
+			n = uploadPartSize
+		}
+
+		if err := w.putPart(bytes.NewReader(w.buf[:n])); err != nil {
+			return err
+		}
+
+		w.flushed += int64(n)
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+	}
+
+	return nil
+}
+
+func (w *uploadWriter) putPart(r io.ReadSeeker) error {
+	if w.upload == nil {
+		upload, err := w.backend.InitUpload(w.tmpKey, nil)
+		if err != nil {
+			return err
+		}
+
+		w.upload = upload
+	}
+
+	w.parts++
+	return w.upload.PutPart(w.parts, r)
+}
+
+// startSpool moves buf and the pending writes into a local temporary file
+func (w *uploadWriter) startSpool() error {
+	spool, err := ioutil.TempFile("", "oss-proxy-upload-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := spool.WriteAt(w.buf, 0); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return err
+	}
+
+	for off, p := range w.pending {
+		if _, err := spool.WriteAt(p, off-w.flushed); err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return err
+		}
+	}
+
+	w.spool = spool
+	w.buf = nil
+	w.pending = make(map[int64][]byte)
+	w.pendingSize = 0
+	return nil
+}
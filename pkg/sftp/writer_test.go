@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/srelab/ossproxy/pkg/storage"
+)
+
+// write is a single WriteAt call, of the bytes [start, end) of the file
+type write struct {
+	start, end int
+}
+
+func sequential(size, chunk int) []write {
+	var writes []write
+	for start := 0; start < size; start += chunk {
+		end := start + chunk
+		if end > size {
+			end = size
+		}
+
+		writes = append(writes, write{start, end})
+	}
+
+	return writes
+}
+
+func reversed(writes []write) []write {
+	for i, j := 0, len(writes)-1; i < j; i, j = i+1, j-1 {
+		writes[i], writes[j] = writes[j], writes[i]
+	}
+
+	return writes
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// tempObjects counts the keys left in the temporary prefix and the
+// multipart uploads still pending
+func tempObjects(t *testing.T, backend *storage.MemoryBackend) int {
+	result, err := backend.List(uploadPrefix, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := backend.Uploads("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(result.Objects) + len(uploads)
+}
+
+func TestUploadWriter(t *testing.T) {
+	const chunk = 32 << 10
+
+	tests := []struct {
+		name    string
+		size    int
+		writes  []write
+		wantErr bool
+	}{
+		{"empty", 0, nil, false},
+		{"small", 1000, sequential(1000, chunk), false},
+		{"single part", uploadPartSize, sequential(uploadPartSize, chunk), false},
+		{"several parts", 2*uploadPartSize + 1234, sequential(2*uploadPartSize+1234, chunk), false},
+		{"reordered", 3 * chunk, []write{{chunk, 2 * chunk}, {2 * chunk, 3 * chunk}, {0, chunk}}, false},
+		{"overlapping", 2 * chunk, []write{{0, chunk + 10}, {chunk, 2 * chunk}}, false},
+		{"spooled", reorderWindow + uploadPartSize, reversed(sequential(reorderWindow+uploadPartSize, 1<<20)), false},
+		{"small spooled", reorderWindow + chunk, reversed(sequential(reorderWindow+chunk, chunk)), false},
+		{"missing data", 3 * chunk, []write{{0, chunk}, {2 * chunk, 3 * chunk}}, true},
+		{"rewrite", uploadPartSize + chunk, append(sequential(uploadPartSize+chunk, chunk), write{0, chunk}), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := storage.NewMemoryBackend()
+			data := testData(test.size)
+
+			w := newUploadWriter(backend, "dir/file")
+
+			var err error
+			for _, write := range test.writes {
+				if _, err = w.WriteAt(data[write.start:write.end], int64(write.start)); err != nil {
+					break
+				}
+			}
+
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("upload error = %v, want an error: %t", err, test.wantErr)
+			}
+
+			stored, getErr := backend.Get("dir/file")
+			switch {
+			case test.wantErr && getErr == nil:
+				t.Error("the failed upload was stored")
+			case !test.wantErr && !bytes.Equal(stored, data):
+				t.Errorf("stored %d bytes (%v), want the %d bytes written", len(stored), getErr, len(data))
+			}
+
+			if n := tempObjects(t, backend); n != 0 {
+				t.Errorf("%d temporary objects or uploads left behind", n)
+			}
+		})
+	}
+}
+
+func TestUploadWriterFail(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	data := testData(uploadPartSize + 1)
+
+	w := newUploadWriter(backend, "file")
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	w.fail(errFailed)
+
+	if err := w.Close(); err != errFailed {
+		t.Errorf("Close() = %v, want %v", err, errFailed)
+	}
+
+	if _, err := backend.Head("file"); err == nil {
+		t.Error("the failed upload was stored")
+	}
+
+	if n := tempObjects(t, backend); n != 0 {
+		t.Errorf("%d temporary objects or uploads left behind", n)
+	}
+}
+
+func TestUploadWriterMeta(t *testing.T) {
+	for _, size := range []int{10, uploadPartSize + 10} {
+		backend := storage.NewMemoryBackend()
+
+		w := newUploadWriter(backend, "file")
+		if _, err := w.WriteAt(testData(size), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		w.setMeta("mode", "600")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		object, err := backend.Head("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if object.Size != int64(size) || object.Meta["mode"] != "600" {
+			t.Errorf("stored %d bytes with meta %v, want %d bytes with mode 600", object.Size, object.Meta, size)
+		}
+	}
+}
+
+// lostCopyBackend reports copies as done without copying anything, like a
+// backend losing a part of a large copy
+type lostCopyBackend struct {
+	*storage.MemoryBackend
+}
+
+func (b lostCopyBackend) Copy(srcBucket, srcKey, dstKey string) error { return nil }
+
+func (b lostCopyBackend) CopyLarge(srcKey, dstKey string, meta map[string]string) error { return nil }
+
+func TestUploadWriterLostCopy(t *testing.T) {
+	backend := lostCopyBackend{storage.NewMemoryBackend()}
+
+	w := newUploadWriter(backend, "file")
+	if _, err := w.WriteAt(testData(10), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err == nil {
+		t.Error("Close() succeeded although the copy to the final key was lost")
+	}
+
+	if _, err := backend.Head("file"); err == nil {
+		t.Error("the lost copy was stored")
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// LargeCopySize is the size from which CopyLarge copies an object part by
+// part, a single copy request is limited to 1GB
+const LargeCopySize = 128 << 20
+
+// Object describes a single key stored in a backend
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// user metadata of the object, only filled in by Head
+	Meta map[string]string
+}
+
+// ListResult holds one page of a List call
+type ListResult struct {
+	Objects     []Object
+	Prefixes    []string
+	IsTruncated bool
+	NextMarker  string
+}
+
+// Upload is an in-progress multipart upload, the object only becomes
+// visible once Complete returns
+type Upload interface {
+	// PutPart uploads part number n, parts are numbered from 1
+	PutPart(n int, r io.ReadSeeker) error
+	Complete() error
+	Abort() error
+}
+
+// PendingUpload is a multipart upload which was started but neither
+// completed nor aborted yet
+type PendingUpload struct {
+	Key string
+	Upload
+}
+
+// Backend is the storage the SFTP filesystem and the HTTP handlers live on.
+// Keys never start with a "/", directories are keys ending with a "/".
+type Backend interface {
+	// List returns at most max keys starting with prefix after marker,
+	// keys sharing a prefix up to delim are grouped into Prefixes
+	List(prefix, delim, marker string, max int) (*ListResult, error)
+	Get(key string) ([]byte, error)
+	// GetRange returns a reader over length bytes starting at offset
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+	Put(key string, data []byte) error
+	// PutWithMeta stores data under key along with the given user metadata
+	PutWithMeta(key string, data []byte, meta map[string]string) error
+	// InitUpload starts a multipart upload of key, the object gets meta as
+	// its user metadata once completed
+	InitUpload(key string, meta map[string]string) (Upload, error)
+	// Uploads returns the pending multipart uploads of the keys starting with prefix
+	Uploads(prefix string) ([]PendingUpload, error)
+	// Copy copies srcKey of srcBucket to dstKey, an empty srcBucket
+	// refers to the backend itself
+	Copy(srcBucket, srcKey, dstKey string) error
+	// CopyLarge copies srcKey to dstKey within the backend, big objects are
+	// copied as several parts in parallel. The copy gets meta as its user
+	// metadata, or the one of srcKey when meta is nil.
+	CopyLarge(srcKey, dstKey string, meta map[string]string) error
+	Delete(keys ...string) error
+	// Head returns os.ErrNotExist when the key is missing
+	Head(key string) (*Object, error)
+	// SetMeta replaces the user metadata of key, its content is left as is
+	SetMeta(key string, meta map[string]string) error
+	SignedURL(key string, expires time.Time) string
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats counts the lookups answered by a CachedBackend
+type CacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Entries int     `json:"entries"`
+}
+
+// CachedBackend keeps the List and Head results of another backend for a
+// while. Every write going through it drops the cached results it may have
+// changed, writes made by other clients of the bucket show up once the
+// cached results expire.
+type CachedBackend struct {
+	Backend
+
+	ttl  time.Duration
+	size int
+
+	hits   uint64
+	misses uint64
+
+	entries map[string]cacheEntry
+	// bumped on every invalidation, results fetched while it changed are dropped
+	generation uint64
+	lock       sync.Mutex
+}
+
+type cacheEntry struct {
+	prefix  string // the key, or the listed prefix, writes below it invalidate the entry
+	list    *ListResult
+	object  *Object
+	expires time.Time
+}
+
+type cachedUpload struct {
+	Upload
+	cache *CachedBackend
+	key   string
+}
+
+// NewCachedBackend returns backend with its metadata cached for ttl, at
+// most size results are kept. A zero ttl disables the cache.
+func NewCachedBackend(backend Backend, ttl time.Duration, size int) *CachedBackend {
+	return &CachedBackend{
+		Backend: backend,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// List returns a cached page when there is one, the result is shared with
+// the other callers and must not be modified
+func (c *CachedBackend) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	key := "list\x00" + prefix + "\x00" + delim + "\x00" + marker + "\x00" + strconv.Itoa(max)
+	if entry, ok := c.lookup(key); ok {
+		return entry.list, nil
+	}
+
+	generation := c.currentGeneration()
+	result, err := c.Backend.List(prefix, delim, marker, max)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(key, cacheEntry{prefix: prefix, list: result}, generation)
+	return result, nil
+}
+
+func (c *CachedBackend) Head(key string) (*Object, error) {
+	if entry, ok := c.lookup("head\x00" + key); ok {
+		object := *entry.object
+		return &object, nil
+	}
+
+	generation := c.currentGeneration()
+	object, err := c.Backend.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := *object
+	c.store("head\x00"+key, cacheEntry{prefix: key, object: &cached}, generation)
+	return object, nil
+}
+
+func (c *CachedBackend) Put(key string, data []byte) error {
+	defer c.Invalidate(key)
+	return c.Backend.Put(key, data)
+}
+
+func (c *CachedBackend) PutWithMeta(key string, data []byte, meta map[string]string) error {
+	defer c.Invalidate(key)
+	return c.Backend.PutWithMeta(key, data, meta)
+}
+
+func (c *CachedBackend) InitUpload(key string, meta map[string]string) (Upload, error) {
+	upload, err := c.Backend.InitUpload(key, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedUpload{Upload: upload, cache: c, key: key}, nil
+}
+
+func (c *CachedBackend) Copy(srcBucket, srcKey, dstKey string) error {
+	defer c.Invalidate(dstKey)
+	return c.Backend.Copy(srcBucket, srcKey, dstKey)
+}
+
+func (c *CachedBackend) CopyLarge(srcKey, dstKey string, meta map[string]string) error {
+	defer c.Invalidate(dstKey)
+	return c.Backend.CopyLarge(srcKey, dstKey, meta)
+}
+
+func (c *CachedBackend) SetMeta(key string, meta map[string]string) error {
+	defer c.Invalidate(key)
+	return c.Backend.SetMeta(key, meta)
+}
+
+func (c *CachedBackend) Delete(keys ...string) error {
+	defer c.Invalidate(keys...)
+	return c.Backend.Delete(keys...)
+}
+
+// Invalidate drops the cached results the given keys are part of
+func (c *CachedBackend) Invalidate(keys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	for cacheKey, entry := range c.entries {
+		for _, key := range keys {
+			if strings.HasPrefix(key, entry.prefix) {
+				delete(c.entries, cacheKey)
+				break
+			}
+		}
+	}
+}
+
+// Stats returns the hit and miss counts since the backend was created
+func (c *CachedBackend) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+
+	c.lock.Lock()
+	stats.Entries = len(c.entries)
+	c.lock.Unlock()
+
+	return stats
+}
+
+func (c *CachedBackend) lookup(key string) (cacheEntry, bool) {
+	if c.ttl <= 0 {
+		return cacheEntry{}, false
+	}
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		atomic.AddUint64(&c.hits, 1)
+		return entry, true
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	return cacheEntry{}, false
+}
+
+func (c *CachedBackend) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.generation
+}
+
+// store caches entry unless an invalidation happened since generation was read
+func (c *CachedBackend) store(key string, entry cacheEntry, generation uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if len(c.entries) >= c.size {
+		c.sweep()
+	}
+
+	entry.expires = time.Now().Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// sweep drops the expired entries, or all of them when none expired yet
+func (c *CachedBackend) sweep() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	if len(c.entries) >= c.size {
+		c.entries = make(map[string]cacheEntry)
+	}
+}
+
+func (u *cachedUpload) Complete() error {
+	defer u.cache.Invalidate(u.key)
+	return u.Upload.Complete()
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the objects in memory, it stands in for OSS where no
+// bucket is at hand, such as in tests
+type MemoryBackend struct {
+	lock    sync.Mutex
+	objects map[string]*memoryObject
+	uploads map[*memoryUpload]bool
+}
+
+type memoryObject struct {
+	data    []byte
+	meta    map[string]string
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string]*memoryObject),
+		uploads: make(map[*memoryUpload]bool),
+	}
+}
+
+// sortedKeys returns the keys starting with prefix in lexical order, as OSS
+// lists them
+func (b *MemoryBackend) sortedKeys(prefix string) []string {
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *MemoryBackend) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := &ListResult{}
+	count := 0
+	for _, key := range b.sortedKeys(prefix) {
+		if key <= marker {
+			continue
+		}
+
+		entry, grouped := key, false
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i >= 0 {
+				entry, grouped = key[:len(prefix)+i+len(delim)], true
+			}
+		}
+
+		// the keys of a prefix already listed, either in this page or up
+		// to the marker, are skipped
+		if grouped && (entry <= marker || (count > 0 && result.NextMarker == entry)) {
+			continue
+		}
+
+		if max > 0 && count == max {
+			result.IsTruncated = true
+			break
+		}
+
+		if grouped {
+			result.Prefixes = append(result.Prefixes, entry)
+		} else {
+			object := b.objects[key]
+			result.Objects = append(result.Objects, Object{Key: key, Size: int64(len(object.data)), ModTime: object.modTime})
+		}
+
+		result.NextMarker = entry
+		count++
+	}
+
+	if !result.IsTruncated {
+		result.NextMarker = ""
+	}
+
+	return result, nil
+}
+
+func (b *MemoryBackend) Get(key string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	object, ok := b.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return object.data, nil
+}
+
+func (b *MemoryBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset >= int64(len(data)) {
+		return nil, fmt.Errorf("range %d-%d of %s is not satisfiable", offset, offset+length-1, key)
+	}
+
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (b *MemoryBackend) Put(key string, data []byte) error {
+	return b.PutWithMeta(key, data, nil)
+}
+
+func (b *MemoryBackend) PutWithMeta(key string, data []byte, meta map[string]string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.objects[key] = &memoryObject{data: append([]byte(nil), data...), meta: copyMeta(meta), modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) InitUpload(key string, meta map[string]string) (Upload, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	upload := &memoryUpload{backend: b, key: key, meta: copyMeta(meta), parts: make(map[int][]byte)}
+	b.uploads[upload] = true
+
+	return upload, nil
+}
+
+func (b *MemoryBackend) Uploads(prefix string) ([]PendingUpload, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var uploads []PendingUpload
+	for upload := range b.uploads {
+		if strings.HasPrefix(upload.key, prefix) {
+			uploads = append(uploads, PendingUpload{Key: upload.key, Upload: upload})
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Key < uploads[j].Key })
+	return uploads, nil
+}
+
+func (b *MemoryBackend) Copy(srcBucket, srcKey, dstKey string) error {
+	if srcBucket != "" {
+		return fmt.Errorf("unable to copy %s from bucket %s, only the memory backend itself is reachable", srcKey, srcBucket)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	object, ok := b.objects[srcKey]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	b.objects[dstKey] = &memoryObject{data: object.data, meta: object.meta, modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) CopyLarge(srcKey, dstKey string, meta map[string]string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	object, ok := b.objects[srcKey]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	if meta == nil {
+		meta = object.meta
+	}
+
+	b.objects[dstKey] = &memoryObject{data: object.data, meta: copyMeta(meta), modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) Delete(keys ...string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, key := range keys {
+		delete(b.objects, key)
+	}
+
+	return nil
+}
+
+func (b *MemoryBackend) Head(key string) (*Object, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	object, ok := b.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &Object{Key: key, Size: int64(len(object.data)), ModTime: object.modTime, Meta: copyMeta(object.meta)}, nil
+}
+
+func (b *MemoryBackend) SetMeta(key string, meta map[string]string) error {
+	return b.CopyLarge(key, key, meta)
+}
+
+func (b *MemoryBackend) SignedURL(key string, expires time.Time) string {
+	return fmt.Sprintf("memory:///%s?Expires=%d", key, expires.Unix())
+}
+
+// memoryUpload gathers the parts in memory until it is completed
+type memoryUpload struct {
+	backend *MemoryBackend
+	key     string
+	meta    map[string]string
+	parts   map[int][]byte
+}
+
+func (u *memoryUpload) PutPart(n int, r io.ReadSeeker) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	u.backend.lock.Lock()
+	defer u.backend.lock.Unlock()
+
+	if !u.backend.uploads[u] {
+		return fmt.Errorf("upload of %s is over", u.key)
+	}
+
+	u.parts[n] = data
+	return nil
+}
+
+func (u *memoryUpload) Complete() error {
+	u.backend.lock.Lock()
+	defer u.backend.lock.Unlock()
+
+	if !u.backend.uploads[u] {
+		return fmt.Errorf("upload of %s is over", u.key)
+	}
+
+	numbers := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var data []byte
+	for _, n := range numbers {
+		data = append(data, u.parts[n]...)
+	}
+
+	delete(u.backend.uploads, u)
+	u.backend.objects[u.key] = &memoryObject{data: data, meta: u.meta, modTime: time.Now()}
+
+	return nil
+}
+
+func (u *memoryUpload) Abort() error {
+	u.backend.lock.Lock()
+	defer u.backend.lock.Unlock()
+
+	delete(u.backend.uploads, u)
+	return nil
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(meta))
+	for name, value := range meta {
+		copied[name] = value
+	}
+
+	return copied
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestBackend(t *testing.T, keys ...string) *MemoryBackend {
+	backend := NewMemoryBackend()
+	for _, key := range keys {
+		if err := backend.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return backend
+}
+
+// listPages lists prefix page by page and returns the entries of each page,
+// the prefixes after the objects
+func listPages(t *testing.T, backend Backend, prefix, delim string, max int) [][]string {
+	var pages [][]string
+	marker := ""
+	for {
+		result, err := backend.List(prefix, delim, marker, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page := []string{}
+		for _, object := range result.Objects {
+			page = append(page, object.Key)
+		}
+		page = append(page, result.Prefixes...)
+		pages = append(pages, page)
+
+		if !result.IsTruncated {
+			return pages
+		}
+
+		if len(pages) > 100 {
+			t.Fatal("listing does not end")
+		}
+		marker = result.NextMarker
+	}
+}
+
+func TestMemoryBackendList(t *testing.T) {
+	keys := []string{"a", "b/", "b/1", "b/2", "c/d/e", "d", "e"}
+
+	tests := []struct {
+		name   string
+		prefix string
+		delim  string
+		max    int
+		want   [][]string
+	}{
+		{"flat", "", "", 0, [][]string{keys}},
+		{"flat pages", "", "", 3, [][]string{{"a", "b/", "b/1"}, {"b/2", "c/d/e", "d"}, {"e"}}},
+		{"grouped", "", "/", 0, [][]string{{"a", "d", "e", "b/", "c/"}}},
+		{"grouped pages", "", "/", 2, [][]string{{"a", "b/"}, {"d", "c/"}, {"e"}}},
+		{"directory", "b/", "/", 0, [][]string{{"b/", "b/1", "b/2"}}},
+		{"nested", "c/", "/", 0, [][]string{{"c/d/"}}},
+		{"missing", "z/", "/", 0, [][]string{{}}},
+	}
+
+	backend := newTestBackend(t, keys...)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := listPages(t, backend, test.prefix, test.delim, test.max); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List(%q, %q) pages = %q, want %q", test.prefix, test.delim, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendUpload(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	upload, err := backend.InitUpload("file", map[string]string{"mode": "644"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n, part := range []string{"world", "hello "} {
+		if err := upload.PutPart(2-n, strings.NewReader(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := backend.Head("file"); err == nil {
+		t.Error("the object exists before the upload is completed")
+	}
+
+	if uploads, _ := backend.Uploads(""); len(uploads) != 1 {
+		t.Errorf("%d pending uploads, want 1", len(uploads))
+	}
+
+	if err := upload.Complete(); err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := backend.Head("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if object.Meta["mode"] != "644" {
+		t.Errorf("meta = %v, want the one of the upload", object.Meta)
+	}
+
+	reader, err := backend.GetRange("file", 6, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if data, _ := ioutil.ReadAll(reader); string(data) != "world" {
+		t.Errorf("GetRange() = %q, want %q", data, "world")
+	}
+
+	if uploads, _ := backend.Uploads(""); len(uploads) != 0 {
+		t.Errorf("%d pending uploads after Complete, want 0", len(uploads))
+	}
+}
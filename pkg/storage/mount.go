@@ -0,0 +1,502 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+// size of the parts an object copied between two backends is sent in
+const mountCopyPartSize = 8 << 20
+
+// Mount maps the directory Path of the proxy onto the root of a bucket
+type Mount struct {
+	Path     string `json:"path"`
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"`
+	Internal bool   `json:"internal"`
+	Secure   bool   `json:"secure"`
+	Bucket   string `json:"bucket"`
+}
+
+// LoadMounts reads the mount table stored as a JSON array in file
+func LoadMounts(file string) ([]Mount, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]Mount, 0)
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", file, err)
+	}
+
+	for _, mount := range mounts {
+		if strings.Trim(mount.Path, "/") == "" || mount.Bucket == "" {
+			return nil, fmt.Errorf("mount %q of %s needs a path below / and a bucket", mount.Path, file)
+		}
+	}
+
+	return mounts, nil
+}
+
+// MountBackend spreads the keys over several backends. A key below the
+// prefix of a mount point lives in the backend of the mount point, without
+// the prefix, every other key lives in the root backend.
+type MountBackend struct {
+	root   Backend
+	points []mountPoint // longest prefix first
+}
+
+type mountPoint struct {
+	prefix  string // always ends with a "/"
+	backend Backend
+}
+
+// listing source of a List call spanning several backends
+type listSource struct {
+	prefix  string // prefix added to the keys of the source
+	backend Backend
+	list    string // prefix listed on the backend
+}
+
+// NewMountBackend returns a MountBackend storing the keys outside of every
+// mount point in root
+func NewMountBackend(root Backend) *MountBackend {
+	return &MountBackend{root: root}
+}
+
+// Mount makes backend hold the keys below dir
+func (m *MountBackend) Mount(dir string, backend Backend) {
+	m.points = append(m.points, mountPoint{prefix: strings.Trim(dir, "/") + "/", backend: backend})
+	sort.Slice(m.points, func(i, j int) bool { return len(m.points[i].prefix) > len(m.points[j].prefix) })
+}
+
+// Roots returns the prefix of every backend, "" standing for the root backend
+func (m *MountBackend) Roots() []string {
+	roots := []string{""}
+	for _, point := range m.points {
+		roots = append(roots, point.prefix)
+	}
+
+	return roots
+}
+
+// Root returns the prefix of the backend holding key
+func (m *MountBackend) Root(key string) string {
+	for _, point := range m.points {
+		if strings.HasPrefix(key, point.prefix) {
+			return point.prefix
+		}
+	}
+
+	return ""
+}
+
+// route returns the backend holding key along with the key on that backend
+func (m *MountBackend) route(key string) (Backend, string, string) {
+	root := m.Root(key)
+	for _, point := range m.points {
+		if point.prefix == root {
+			return point.backend, strings.TrimPrefix(key, root), root
+		}
+	}
+
+	return m.root, key, ""
+}
+
+// routeObject routes key like route, the directory of a mount point has no
+// key on its backend and is refused
+func (m *MountBackend) routeObject(op, key string) (Backend, string, error) {
+	backend, rel, root := m.route(key)
+	if root != "" && rel == "" {
+		return nil, "", &os.PathError{Op: op, Path: key, Err: os.ErrPermission}
+	}
+
+	return backend, rel, nil
+}
+
+// isMountPoint tells whether key is the directory of a mount point, which
+// only exists on the proxy
+func (m *MountBackend) isMountPoint(key string) bool {
+	_, rel, root := m.route(key)
+	return root != "" && rel == ""
+}
+
+func (m *MountBackend) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	if backend, key, root := m.route(prefix); root != "" {
+		if marker != "" {
+			marker = strings.TrimPrefix(marker, root)
+		}
+
+		result, err := backend.List(key, delim, marker, max)
+		if err != nil {
+			return nil, err
+		}
+
+		return rebase(result, root), nil
+	}
+
+	if delim != "" {
+		return m.listRoot(prefix, delim, marker, max)
+	}
+
+	return m.listAll(prefix, marker, max)
+}
+
+// listRoot lists prefix on the root backend, the mount points below it
+// show up as directories on the first page
+func (m *MountBackend) listRoot(prefix, delim, marker string, max int) (*ListResult, error) {
+	resp, err := m.root.List(prefix, delim, marker, max)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{
+		Objects:     make([]Object, 0, len(resp.Objects)),
+		Prefixes:    make([]string, 0, len(resp.Prefixes)),
+		IsTruncated: resp.IsTruncated,
+		NextMarker:  resp.NextMarker,
+	}
+
+	seen := make(map[string]bool)
+	for _, object := range resp.Objects {
+		if m.Root(object.Key) == "" {
+			result.Objects = append(result.Objects, object)
+		}
+	}
+
+	for _, commonPrefix := range resp.Prefixes {
+		seen[commonPrefix] = true
+		result.Prefixes = append(result.Prefixes, commonPrefix)
+	}
+
+	if marker != "" {
+		return result, nil
+	}
+
+	for _, point := range m.points {
+		if !strings.HasPrefix(point.prefix, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(point.prefix, prefix)
+		commonPrefix := prefix + rest[:strings.Index(rest, delim)+len(delim)]
+		if !seen[commonPrefix] {
+			seen[commonPrefix] = true
+			result.Prefixes = append(result.Prefixes, commonPrefix)
+		}
+	}
+
+	return result, nil
+}
+
+// listAll lists every key below prefix, the root backend first and the
+// mount points below prefix one after the other. The marker carries the
+// index of the source the listing is at.
+func (m *MountBackend) listAll(prefix, marker string, max int) (*ListResult, error) {
+	sources := []listSource{{prefix: "", backend: m.root, list: prefix}}
+	for _, point := range m.points {
+		if strings.HasPrefix(point.prefix, prefix) {
+			sources = append(sources, listSource{prefix: point.prefix, backend: point.backend, list: ""})
+		}
+	}
+
+	sort.Slice(sources[1:], func(i, j int) bool { return sources[i+1].prefix < sources[j+1].prefix })
+
+	index := 0
+	if marker != "" {
+		parts := strings.SplitN(marker, "\x00", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid list marker %q", marker)
+		}
+
+		var err error
+		if index, err = strconv.Atoi(parts[0]); err != nil || index >= len(sources) {
+			return nil, fmt.Errorf("invalid list marker %q", marker)
+		}
+
+		marker = parts[1]
+	}
+
+	source := sources[index]
+	resp, err := source.backend.List(source.list, "", marker, max)
+	if err != nil {
+		return nil, err
+	}
+
+	result := rebase(resp, source.prefix)
+	if index == 0 {
+		objects := result.Objects[:0]
+		for _, object := range result.Objects {
+			if m.Root(object.Key) == "" {
+				objects = append(objects, object)
+			}
+		}
+
+		result.Objects = objects
+	}
+
+	switch {
+	case resp.IsTruncated && resp.NextMarker != "":
+		result.NextMarker = strconv.Itoa(index) + "\x00" + resp.NextMarker
+	case index+1 < len(sources):
+		result.IsTruncated = true
+		result.NextMarker = strconv.Itoa(index+1) + "\x00"
+	default:
+		result.IsTruncated = false
+		result.NextMarker = ""
+	}
+
+	return result, nil
+}
+
+func (m *MountBackend) Get(key string) ([]byte, error) {
+	backend, key, err := m.routeObject("get", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.Get(key)
+}
+
+func (m *MountBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	backend, key, err := m.routeObject("get", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.GetRange(key, offset, length)
+}
+
+// Put stores data under key, the directory of a mount point always exists
+// and is left as is
+func (m *MountBackend) Put(key string, data []byte) error {
+	if m.isMountPoint(key) {
+		return nil
+	}
+
+	backend, key, _ := m.route(key)
+	return backend.Put(key, data)
+}
+
+func (m *MountBackend) PutWithMeta(key string, data []byte, meta map[string]string) error {
+	if m.isMountPoint(key) {
+		return nil
+	}
+
+	backend, key, _ := m.route(key)
+	return backend.PutWithMeta(key, data, meta)
+}
+
+func (m *MountBackend) InitUpload(key string, meta map[string]string) (Upload, error) {
+	backend, key, err := m.routeObject("upload", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.InitUpload(key, meta)
+}
+
+func (m *MountBackend) Uploads(prefix string) ([]PendingUpload, error) {
+	backend, key, root := m.route(prefix)
+
+	uploads, err := backend.Uploads(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range uploads {
+		uploads[index].Key = root + uploads[index].Key
+	}
+
+	return uploads, nil
+}
+
+func (m *MountBackend) Copy(srcBucket, srcKey, dstKey string) error {
+	if _, _, err := m.routeObject("copy", dstKey); err != nil {
+		return err
+	}
+
+	dst, dstKey, dstRoot := m.route(dstKey)
+	if srcBucket != "" {
+		return dst.Copy(srcBucket, srcKey, dstKey)
+	}
+
+	if _, _, err := m.routeObject("copy", srcKey); err != nil {
+		return err
+	}
+
+	src, srcKey, srcRoot := m.route(srcKey)
+	if srcRoot == dstRoot {
+		return dst.Copy("", srcKey, dstKey)
+	}
+
+	return copyAcross(src, srcKey, dst, dstKey, nil)
+}
+
+func (m *MountBackend) CopyLarge(srcKey, dstKey string, meta map[string]string) error {
+	for _, key := range []string{srcKey, dstKey} {
+		if _, _, err := m.routeObject("copy", key); err != nil {
+			return err
+		}
+	}
+
+	src, srcKey, srcRoot := m.route(srcKey)
+	dst, dstKey, dstRoot := m.route(dstKey)
+	if srcRoot == dstRoot {
+		return dst.CopyLarge(srcKey, dstKey, meta)
+	}
+
+	return copyAcross(src, srcKey, dst, dstKey, meta)
+}
+
+func (m *MountBackend) Delete(keys ...string) error {
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		if _, _, err := m.routeObject("delete", key); err != nil {
+			return err
+		}
+
+		_, key, root := m.route(key)
+		groups[root] = append(groups[root], key)
+	}
+
+	for root, keys := range groups {
+		backend, _, _ := m.route(root)
+		if err := backend.Delete(keys...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Head returns the directory of a mount point as an empty object, it is
+// never looked up on the backend
+func (m *MountBackend) Head(key string) (*Object, error) {
+	if m.isMountPoint(key) {
+		return &Object{Key: key}, nil
+	}
+
+	backend, rel, _ := m.route(key)
+
+	object, err := backend.Head(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	object.Key = key
+	return object, nil
+}
+
+func (m *MountBackend) SetMeta(key string, meta map[string]string) error {
+	backend, key, err := m.routeObject("setmeta", key)
+	if err != nil {
+		return err
+	}
+
+	return backend.SetMeta(key, meta)
+}
+
+func (m *MountBackend) SignedURL(key string, expires time.Time) string {
+	backend, key, err := m.routeObject("sign", key)
+	if err != nil {
+		return ""
+	}
+
+	return backend.SignedURL(key, expires)
+}
+
+// rebase returns result with prefix added to its keys
+func rebase(result *ListResult, prefix string) *ListResult {
+	rebased := &ListResult{
+		Objects:     make([]Object, len(result.Objects)),
+		Prefixes:    make([]string, len(result.Prefixes)),
+		IsTruncated: result.IsTruncated,
+		NextMarker:  result.NextMarker,
+	}
+
+	for index, object := range result.Objects {
+		object.Key = prefix + object.Key
+		rebased.Objects[index] = object
+	}
+
+	for index, commonPrefix := range result.Prefixes {
+		rebased.Prefixes[index] = prefix + commonPrefix
+	}
+
+	if rebased.NextMarker != "" {
+		rebased.NextMarker = prefix + rebased.NextMarker
+	}
+
+	return rebased
+}
+
+// copyAcross copies srcKey of src to dstKey of dst through the proxy, part
+// by part, a nil meta keeps the user metadata of srcKey
+func copyAcross(src Backend, srcKey string, dst Backend, dstKey string, meta map[string]string) error {
+	object, err := src.Head(srcKey)
+	if err != nil {
+		return err
+	}
+
+	if meta == nil {
+		meta = object.Meta
+	}
+
+	if object.Size <= mountCopyPartSize {
+		data, err := src.Get(srcKey)
+		if err != nil {
+			return err
+		}
+
+		return dst.PutWithMeta(dstKey, data, meta)
+	}
+
+	upload, err := dst.InitUpload(dstKey, meta)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, mountCopyPartSize)
+	for part, offset := 1, int64(0); offset < object.Size; part, offset = part+1, offset+mountCopyPartSize {
+		length := object.Size - offset
+		if length > mountCopyPartSize {
+			length = mountCopyPartSize
+		}
+
+		if err := copyPart(src, srcKey, upload, part, offset, buf[:length]); err != nil {
+			if aerr := upload.Abort(); aerr != nil {
+				logger.Errorf("unable to abort the copy of %s to %s: %s", srcKey, dstKey, aerr)
+			}
+
+			return err
+		}
+	}
+
+	return upload.Complete()
+}
+
+func copyPart(src Backend, srcKey string, upload Upload, part int, offset int64, buf []byte) error {
+	body, err := src.GetRange(srcKey, offset, int64(len(buf)))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return err
+	}
+
+	return upload.PutPart(part, bytes.NewReader(buf))
+}
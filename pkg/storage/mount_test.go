@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestMounts returns a MountBackend with archive/ and logs/ mounted,
+// along with its backends
+func newTestMounts(t *testing.T) (*MountBackend, map[string]*MemoryBackend) {
+	backends := map[string]*MemoryBackend{
+		"":         newTestBackend(t, "a", "archive/shadowed", "b/c", "z"),
+		"archive/": newTestBackend(t, "x", "y/1"),
+		"logs/":    newTestBackend(t, "old"),
+	}
+
+	mounts := NewMountBackend(backends[""])
+	mounts.Mount("/archive/", backends["archive/"])
+	mounts.Mount("logs", backends["logs/"])
+
+	return mounts, backends
+}
+
+func TestMountRoute(t *testing.T) {
+	mounts, backends := newTestMounts(t)
+
+	tests := []struct {
+		key     string
+		root    string
+		backend string
+	}{
+		{"a", "", "a"},
+		{"archive", "", "archive"},
+		{"archive/x", "archive/", "x"},
+		{"archive/y/1", "archive/", "y/1"},
+		{"logs", "", "logs"},
+		{"logs/old", "logs/", "old"},
+		{"archived/x", "", "archived/x"},
+	}
+
+	for _, test := range tests {
+		backend, key, root := mounts.route(test.key)
+		if root != test.root || key != test.backend || backend != Backend(backends[test.root]) {
+			t.Errorf("route(%q) = %q on %q, want %q on %q", test.key, key, root, test.backend, test.root)
+		}
+	}
+}
+
+func TestMountList(t *testing.T) {
+	mounts, _ := newTestMounts(t)
+
+	tests := []struct {
+		name   string
+		prefix string
+		delim  string
+		max    int
+		want   [][]string
+	}{
+		{"root", "", "/", 0, [][]string{{"a", "z", "archive/", "b/", "logs/"}}},
+		{"root directory", "b/", "/", 0, [][]string{{"b/c"}}},
+		{"mount point", "archive/", "/", 0, [][]string{{"archive/x", "archive/y/"}}},
+		{"mount point directory", "archive/y/", "/", 0, [][]string{{"archive/y/1"}}},
+		{"everything", "", "", 0, [][]string{{"a", "b/c", "z"}, {"archive/x", "archive/y/1"}, {"logs/old"}}},
+		// the keys shadowed by a mount point leave the first page short
+		{"everything in pages", "", "", 2, [][]string{{"a"}, {"b/c", "z"}, {"archive/x", "archive/y/1"}, {"logs/old"}}},
+		{"below a mount point", "archive/", "", 0, [][]string{{"archive/x", "archive/y/1"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := listPages(t, mounts, test.prefix, test.delim, test.max); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List(%q, %q) pages = %q, want %q", test.prefix, test.delim, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMountDelete(t *testing.T) {
+	mounts, backends := newTestMounts(t)
+
+	if err := mounts.Delete("a", "archive/x", "logs/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	for root, key := range map[string]string{"": "a", "archive/": "x", "logs/": "old"} {
+		if _, err := backends[root].Head(key); !os.IsNotExist(err) {
+			t.Errorf("%s of %q was not deleted: %v", key, root, err)
+		}
+	}
+
+	if _, err := backends["archive/"].Head("y/1"); err != nil {
+		t.Errorf("y/1 of archive/ is gone: %v", err)
+	}
+}
+
+func TestMountPoint(t *testing.T) {
+	mounts, backends := newTestMounts(t)
+
+	object, err := mounts.Head("archive/")
+	if err != nil || object.Key != "archive/" {
+		t.Errorf("Head(archive/) = %+v, %v, want the directory of the mount point", object, err)
+	}
+
+	if err := mounts.Put("archive/", nil); err != nil {
+		t.Errorf("Put(archive/) = %v, want the directory left as is", err)
+	}
+
+	if err := mounts.PutWithMeta("archive/", nil, map[string]string{"mode": "755"}); err != nil {
+		t.Errorf("PutWithMeta(archive/) = %v, want the directory left as is", err)
+	}
+
+	if err := mounts.Delete("a", "archive/"); !os.IsPermission(err) {
+		t.Errorf("Delete(archive/) = %v, want a permission error", err)
+	}
+
+	if _, err := backends[""].Head("a"); err != nil {
+		t.Errorf("a was deleted along with the mount point: %v", err)
+	}
+
+	if err := mounts.SetMeta("archive/", map[string]string{"mode": "755"}); !os.IsPermission(err) {
+		t.Errorf("SetMeta(archive/) = %v, want a permission error", err)
+	}
+
+	if err := mounts.Copy("", "a", "archive/"); !os.IsPermission(err) {
+		t.Errorf("Copy(a, archive/) = %v, want a permission error", err)
+	}
+
+	// no request ever reaches the backend with an empty key
+	result, err := backends["archive/"].List("", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Objects) != 2 {
+		t.Errorf("archive/ holds %d objects, want its 2 objects untouched", len(result.Objects))
+	}
+}
+
+func TestMountCopyAcross(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		meta map[string]string
+		want map[string]string
+	}{
+		{"small", 100, nil, map[string]string{"mode": "644"}},
+		{"small with meta", 100, map[string]string{"mode": "600"}, map[string]string{"mode": "600"}},
+		{"multipart", 2*mountCopyPartSize + 1, nil, map[string]string{"mode": "644"}},
+		{"multipart with meta", 2*mountCopyPartSize + 1, map[string]string{"mode": "600"}, map[string]string{"mode": "600"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounts, backends := newTestMounts(t)
+
+			data := bytes.Repeat([]byte{1, 2, 3}, test.size/3+1)[:test.size]
+			if err := mounts.PutWithMeta("src", data, map[string]string{"mode": "644"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := mounts.CopyLarge("src", "archive/dst", test.meta); err != nil {
+				t.Fatal(err)
+			}
+
+			object, err := backends["archive/"].Head("dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(object.Meta, test.want) {
+				t.Errorf("copy meta = %v, want %v", object.Meta, test.want)
+			}
+
+			if copied, _ := backends["archive/"].Get("dst"); !bytes.Equal(copied, data) {
+				t.Errorf("copied %d bytes, want %d", len(copied), len(data))
+			}
+
+			if uploads, _ := backends["archive/"].Uploads(""); len(uploads) != 0 {
+				t.Errorf("%d uploads left behind", len(uploads))
+			}
+		})
+	}
+}
+
+func TestLoadMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oss-proxy-mounts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", `[]`, []string{}, false},
+		{"mounts", `[{"path": "/logs", "bucket": "logs"}, {"path": "data/", "bucket": "data"}]`, []string{"/logs", "data/"}, false},
+		{"root path", `[{"path": "/", "bucket": "logs"}]`, nil, true},
+		{"no bucket", `[{"path": "/logs"}]`, nil, true},
+		{"invalid", `{"path": "/logs"}`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "mounts.json")
+			if err := ioutil.WriteFile(file, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			mounts, err := LoadMounts(file)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("LoadMounts() error = %v, want an error: %t", err, test.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			paths := []string{}
+			for _, mount := range mounts {
+				paths = append(paths, mount.Path)
+			}
+			sort.Strings(paths)
+
+			if !reflect.DeepEqual(paths, test.want) {
+				t.Errorf("LoadMounts() paths = %q, want %q", paths, test.want)
+			}
+		})
+	}
+}
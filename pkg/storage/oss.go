@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denverdino/aliyungo/oss"
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+const (
+	// maximum number of keys accepted by a single DelMulti call
+	maxDeleteKeys = 1000
+	// number of parts of a large object copied at the same time
+	copyConcurrency = 4
+	// prefix of the headers carrying the user metadata of an object
+	metaHeaderPrefix = "X-Oss-Meta-"
+)
+
+type ossBackend struct {
+	bucket *oss.Bucket
+	lock   sync.RWMutex
+}
+
+type ossUpload struct {
+	backend *ossBackend
+	multi   *oss.Multi
+	parts   []oss.Part
+	lock    sync.Mutex
+}
+
+// NewOSSClient returns a client of the given region, a non-empty endpoint
+// replaces the one of the region
+func NewOSSClient(region, endpoint string, internal, secure bool, creds Credentials) *oss.Client {
+	client := oss.NewOSSClientForAssumeRole(
+		oss.Region(region),
+		internal,
+		creds.AccessKeyID,
+		creds.AccessKeySecret,
+		creds.SecurityToken,
+		secure,
+	)
+
+	if endpoint != "" {
+		client.SetEndpoint(endpoint)
+	}
+
+	return client
+}
+
+// NewOSSBackend returns a Backend storing its objects in the given bucket
+func NewOSSBackend(bucket *oss.Bucket) Backend {
+	return &ossBackend{bucket: bucket}
+}
+
+// SetCredentials makes the requests started from now on use creds, the
+// requests in flight keep the credentials they were signed with
+func (b *ossBackend) SetCredentials(creds Credentials) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	client := *b.bucket.Client
+	client.AccessKeyId = creds.AccessKeyID
+	client.AccessKeySecret = creds.AccessKeySecret
+	client.SecurityToken = creds.SecurityToken
+
+	b.bucket = &oss.Bucket{Client: &client, Name: b.bucket.Name}
+}
+
+func (b *ossBackend) current() *oss.Bucket {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.bucket
+}
+
+func (b *ossBackend) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	resp, err := b.current().List(prefix, delim, marker, max)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{
+		Objects:     make([]Object, 0, len(resp.Contents)),
+		Prefixes:    resp.CommonPrefixes,
+		IsTruncated: resp.IsTruncated,
+		NextMarker:  resp.NextMarker,
+	}
+
+	for _, content := range resp.Contents {
+		modtime, err := time.Parse(time.RFC3339, content.LastModified)
+		if err != nil {
+			modtime = time.Now()
+		}
+
+		result.Objects = append(result.Objects, Object{Key: content.Key, Size: content.Size, ModTime: modtime})
+	}
+
+	return result, nil
+}
+
+func (b *ossBackend) Get(key string) ([]byte, error) {
+	data, err := b.current().Get(key)
+	return data, notExist(err)
+}
+
+func (b *ossBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	headers := make(http.Header)
+	headers.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := b.current().GetResponseWithHeaders(key, headers)
+	if err != nil {
+		return nil, notExist(err)
+	}
+
+	// oss ignores a range past the end of the object and answers with all
+	// of it, which must not be taken for the requested bytes
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("range %d-%d of %s not served, status %d", offset, offset+length-1, key, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *ossBackend) Put(key string, data []byte) error {
+	return b.current().Put(key, data, oss.DefaultContentType, oss.Private, oss.Options{})
+}
+
+func (b *ossBackend) PutWithMeta(key string, data []byte, meta map[string]string) error {
+	options := oss.Options{Meta: make(map[string][]string, len(meta))}
+	for name, value := range meta {
+		options.Meta[name] = []string{value}
+	}
+
+	return b.current().Put(key, data, oss.DefaultContentType, oss.Private, options)
+}
+
+func (b *ossBackend) InitUpload(key string, meta map[string]string) (Upload, error) {
+	options := oss.Options{Meta: make(map[string][]string, len(meta))}
+	for name, value := range meta {
+		options.Meta[name] = []string{value}
+	}
+
+	multi, err := b.current().InitMulti(key, oss.DefaultContentType, oss.Private, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ossUpload{backend: b, multi: multi}, nil
+}
+
+func (b *ossBackend) Uploads(prefix string) ([]PendingUpload, error) {
+	multis, _, err := b.current().ListMulti(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := make([]PendingUpload, len(multis))
+	for index, multi := range multis {
+		uploads[index] = PendingUpload{Key: multi.Key, Upload: &ossUpload{backend: b, multi: multi}}
+	}
+
+	return uploads, nil
+}
+
+func (b *ossBackend) Copy(srcBucket, srcKey, dstKey string) error {
+	source := b.current().Path(srcKey)
+	if srcBucket != "" {
+		source = path.Join("/", srcBucket, srcKey)
+	}
+
+	_, err := b.current().PutCopy(dstKey, oss.Private, oss.CopyOptions{}, source)
+	return notExist(err)
+}
+
+func (b *ossBackend) CopyLarge(srcKey, dstKey string, meta map[string]string) error {
+	object, err := b.Head(srcKey)
+	if err != nil {
+		return err
+	}
+
+	if meta == nil {
+		meta = object.Meta
+	}
+
+	// a single copy request is limited to 1GB, and the multipart copy of
+	// the oss package drops the metadata of the small objects
+	bucket := b.current()
+	if object.Size < LargeCopySize {
+		options := oss.CopyOptions{Headers: metaHeaders(meta), MetadataDirective: "REPLACE"}
+		_, err := bucket.PutCopy(dstKey, oss.Private, options, bucket.Path(srcKey))
+		return notExist(err)
+	}
+
+	options := oss.Options{Meta: make(map[string][]string, len(meta))}
+	for name, value := range meta {
+		options.Meta[name] = []string{value}
+	}
+
+	multi, err := bucket.InitMulti(dstKey, oss.DefaultContentType, oss.Private, options)
+	if err != nil {
+		return err
+	}
+
+	// the copy of the oss package aborts the upload when a part fails and
+	// returns the result of the abort, a failed copy would pass for done
+	parts, err := copyParts(multi, bucket.Path(srcKey), object.Size)
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+
+	if err != nil {
+		if aerr := multi.Abort(); aerr != nil {
+			logger.Errorf("unable to abort the copy of %s to %s: %s", srcKey, dstKey, aerr)
+		}
+
+		return notExist(err)
+	}
+
+	return nil
+}
+
+// copyParts copies the size bytes of source into the parts of multi,
+// copyConcurrency of them at the same time, and returns the first error
+func copyParts(multi *oss.Multi, source string, size int64) ([]oss.Part, error) {
+	parts := make([]oss.Part, (size+LargeCopySize-1)/LargeCopySize)
+
+	var (
+		firstErr error
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	limiter := make(chan struct{}, copyConcurrency)
+	for index := range parts {
+		start := int64(index) * LargeCopySize
+		end := start + LargeCopySize
+		if end > size {
+			end = size
+		}
+
+		limiter <- struct{}{}
+		wg.Add(1)
+
+		go func(index int, start, end int64) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			options := oss.CopyOptions{CopySourceOptions: fmt.Sprintf("bytes=%d-%d", start, end-1)}
+			_, part, err := multi.PutPartCopyWithContentLength(index+1, options, source, end-start)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("unable to copy part %d of %s: %s", index+1, source, err)
+			}
+
+			parts[index] = part
+		}(index, start, end)
+	}
+
+	wg.Wait()
+	return parts, firstErr
+}
+
+func (b *ossBackend) Delete(keys ...string) error {
+	if len(keys) == 1 {
+		return b.current().Del(keys[0])
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+
+		objects := make([]oss.Object, n)
+		for index, key := range keys[:n] {
+			objects[index] = oss.Object{Key: key}
+		}
+
+		if err := b.current().DelMulti(oss.Delete{Quiet: true, Objects: objects}); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+func (b *ossBackend) Head(key string) (*Object, error) {
+	resp, err := b.current().Head(key, nil)
+	if err != nil {
+		return nil, notExist(err)
+	}
+
+	modtime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modtime = time.Now()
+	}
+
+	meta := make(map[string]string)
+	for name := range resp.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) {
+			meta[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = resp.Header.Get(name)
+		}
+	}
+
+	return &Object{Key: key, Size: resp.ContentLength, ModTime: modtime, Meta: meta}, nil
+}
+
+// SetMeta copies key onto itself with meta, part by part when it is big
+func (b *ossBackend) SetMeta(key string, meta map[string]string) error {
+	if meta == nil {
+		meta = make(map[string]string)
+	}
+
+	return b.CopyLarge(key, key, meta)
+}
+
+func (b *ossBackend) SignedURL(key string, expires time.Time) string {
+	return b.current().SignedURL(key, expires)
+}
+
+func (u *ossUpload) PutPart(n int, r io.ReadSeeker) error {
+	part, err := u.current().PutPart(n, r)
+	if err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.parts = append(u.parts, part)
+	return nil
+}
+
+func (u *ossUpload) Complete() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.current().Complete(u.parts)
+}
+
+func (u *ossUpload) Abort() error {
+	return u.current().Abort()
+}
+
+// current returns the upload bound to the current credentials of the backend
+func (u *ossUpload) current() *oss.Multi {
+	multi := *u.multi
+	multi.Bucket = u.backend.current()
+	return &multi
+}
+
+// metaHeaders returns the headers setting meta as the user metadata of an object
+func metaHeaders(meta map[string]string) http.Header {
+	headers := make(http.Header)
+	for name, value := range meta {
+		headers.Set(metaHeaderPrefix+name, value)
+	}
+
+	return headers
+}
+
+// notExist translates OSS "not found" errors into os.ErrNotExist
+func notExist(err error) error {
+	if e, ok := err.(*oss.Error); ok && e.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+
+	return err
+}
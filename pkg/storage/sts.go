@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/srelab/ossproxy/pkg/logger"
+)
+
+const (
+	// credentials are refreshed this long before they expire
+	refreshMargin = 5 * time.Minute
+	// delay before fetching credentials again after a failure
+	refreshRetry = 30 * time.Second
+	// delay between two fetches of credentials without an expiration
+	refreshDefault = 15 * time.Minute
+	stsTimeout     = 10 * time.Second
+)
+
+// Credentials are the keys requests are signed with, SecurityToken and
+// Expiration are only set for STS temporary credentials
+type Credentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	AccessKeySecret string    `json:"AccessKeySecret"`
+	SecurityToken   string    `json:"SecurityToken"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// CredentialSetter is implemented by the backends whose credentials can be
+// replaced while they are in use
+type CredentialSetter interface {
+	SetCredentials(creds Credentials)
+}
+
+// CredentialSource fetches fresh STS credentials
+type CredentialSource func() (*Credentials, error)
+
+// NewCredentialSource returns a source reading the credentials from location,
+// an http(s) URL such as the ECS RAM role endpoint or a local file, both
+// holding the JSON document returned by AssumeRole
+func NewCredentialSource(location string) CredentialSource {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: stsTimeout}
+
+		return func() (*Credentials, error) {
+			resp, err := client.Get(location)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("%s answered %s", location, resp.Status)
+			}
+
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			return parseCredentials(data)
+		}
+	}
+
+	return func() (*Credentials, error) {
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseCredentials(data)
+	}
+}
+
+func parseCredentials(data []byte) (*Credentials, error) {
+	doc := struct {
+		Credentials
+		Wrapped *Credentials `json:"Credentials"`
+	}{}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse credentials: %s", err)
+	}
+
+	creds := &doc.Credentials
+	if doc.Wrapped != nil {
+		creds = doc.Wrapped
+	}
+
+	if creds.AccessKeyID == "" || creds.AccessKeySecret == "" {
+		return nil, fmt.Errorf("credentials without an access key")
+	}
+
+	return creds, nil
+}
+
+// RefreshCredentials fetches credentials from source before the current
+// ones expire and hands them to the backends, it never returns
+func RefreshCredentials(source CredentialSource, current Credentials, backends ...Backend) {
+	refreshLoop(source, current, time.Sleep, backends)
+}
+
+// refreshLoop is RefreshCredentials waiting with sleep
+func refreshLoop(source CredentialSource, current Credentials, sleep func(time.Duration), backends []Backend) {
+	delay := refreshDelay(current)
+	for {
+		sleep(delay)
+
+		creds, err := source()
+		if err != nil {
+			logger.Errorf("unable to refresh sts credentials: %s", err)
+			delay = refreshRetry
+			continue
+		}
+
+		for _, backend := range backends {
+			if setter, ok := backend.(CredentialSetter); ok {
+				setter.SetCredentials(*creds)
+			}
+		}
+
+		logger.Infof("sts credentials refreshed, they expire at %s", creds.Expiration.Format(time.RFC3339))
+		current = *creds
+
+		// credentials handed out close to their expiration would be
+		// fetched again right away otherwise
+		if delay = refreshDelay(current); delay < refreshRetry {
+			logger.Warnf("sts credentials expire within %s, fetching them again in %s", refreshMargin, refreshRetry)
+			delay = refreshRetry
+		}
+	}
+}
+
+// refreshDelay returns how long creds can still be used
+func refreshDelay(creds Credentials) time.Duration {
+	if creds.Expiration.IsZero() {
+		return refreshDefault
+	}
+
+	delay := time.Until(creds.Expiration) - refreshMargin
+	if delay < 0 {
+		return 0
+	}
+
+	return delay
+}
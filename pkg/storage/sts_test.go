@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRefreshNearExpiry(t *testing.T) {
+	near := Credentials{AccessKeyID: "id", AccessKeySecret: "secret", Expiration: time.Now().Add(time.Minute)}
+
+	fetches := 0
+	source := func() (*Credentials, error) {
+		fetches++
+		creds := near
+		return &creds, nil
+	}
+
+	delays := make([]time.Duration, 0)
+	sleep := func(delay time.Duration) {
+		delays = append(delays, delay)
+		if len(delays) == 5 {
+			runtime.Goexit()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		refreshLoop(source, near, sleep, nil)
+	}()
+	<-done
+
+	if fetches != 4 {
+		t.Errorf("fetched the credentials %d times, want 4", fetches)
+	}
+
+	// the first fetch is due right away, the next ones get the same
+	// credentials and back off
+	for index, delay := range delays[1:] {
+		if delay < refreshRetry {
+			t.Errorf("refresh %d came after %s, want at least %s", index+1, delay, refreshRetry)
+		}
+	}
+}